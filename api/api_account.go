@@ -0,0 +1,548 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// NovelAI 登录相关的常量
+const (
+	novelAILoginPath     = "/user/login"
+	accessKeyDomain      = "novelai_data_access_key" // 计算 access key 时加入盐的域名，与官方客户端相同
+	accountRetryInterval = 5 * time.Minute           // 登录失败后多久再自动重试
+	accountCheckInterval = time.Minute               // 检查令牌是否即将过期的间隔
+	accountLoginGrace    = time.Minute               // 刚登录得到的令牌返回 401 时不再重复登录
+)
+
+var (
+	// ErrAccountNotFound 表示没有找到指定 id 的账号
+	ErrAccountNotFound = errors.New("account not found")
+	// ErrAccountExists 表示邮箱已经添加过
+	ErrAccountExists = errors.New("account already exists")
+)
+
+// AccountRecord 是秘钥库中保存的一个 NovelAI 账号
+type AccountRecord struct {
+	ID        string    `json:"id"` // 由邮箱计算出的固定短 id
+	Email     string    `json:"email"`
+	Password  string    `json:"password"` // AES-GCM 加密后的密码，base64(nonce + 密文)
+	Label     string    `json:"label,omitempty"`
+	Token     string    `json:"token,omitempty"` // 最近一次登录得到的访问令牌
+	ExpiresAt time.Time `json:"expires_at"`      // 令牌的过期时间，取自 JWT 的 exp
+	AddedAt   time.Time `json:"added_at"`
+	LoginAt   time.Time `json:"login_at"`
+	LastError string    `json:"last_error,omitempty"` // 最近一次登录失败的原因，成功后清空
+}
+
+// AccountView 是管理接口中展示的一个账号，不包含密码，令牌已隐藏中间部分
+type AccountView struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Label     string    `json:"label,omitempty"`
+	KeyID     string    `json:"key_id,omitempty"` // 令牌在秘钥池中的 id
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	AddedAt   time.Time `json:"added_at"`
+	LoginAt   time.Time `json:"login_at"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// view 返回账号的展示信息
+func (rec *AccountRecord) view() AccountView {
+	v := AccountView{
+		ID:        rec.ID,
+		Email:     rec.Email,
+		Label:     rec.Label,
+		ExpiresAt: rec.ExpiresAt,
+		AddedAt:   rec.AddedAt,
+		LoginAt:   rec.LoginAt,
+		LastError: rec.LastError,
+	}
+	if rec.Token != "" {
+		v.KeyID, v.Token = keyID(rec.Token), maskSecret(rec.Token)
+	}
+	return v
+}
+
+// accountManager 保存账号并负责登录与自动重新登录
+// 需要同时持有秘钥池的锁时，先锁 accountManager.mu 再锁 KeyPool.mu
+type accountManager struct {
+	mu        sync.Mutex
+	store     *keyStore
+	aead      cipher.AEAD
+	accounts  map[string]*AccountRecord // id => 账号
+	relogging map[string]bool           // 正在登录的账号，避免同一账号并发登录
+	nextTry   map[string]time.Time      // 登录失败的账号下一次自动重试的时间
+}
+
+// accountPool 是全局的账号管理，由 InitAccounts 初始化
+var accountPool = newAccountManager(nil, nil)
+
+// newAccountManager 创建一个空的账号管理
+func newAccountManager(store *keyStore, aead cipher.AEAD) *accountManager {
+	return &accountManager{
+		store:     store,
+		aead:      aead,
+		accounts:  make(map[string]*AccountRecord),
+		relogging: make(map[string]bool),
+		nextTry:   make(map[string]time.Time),
+	}
+}
+
+// InitAccounts 加载秘钥库中的账号，需要在 InitKeyPool 之后调用
+// 密码的加密密钥由 accounts.secret 派生，未配置时读取（不存在时生成）accounts.key_file
+func InitAccounts(cfg AccountsConfig) error {
+	keyPool.mu.Lock()
+	store := keyPool.store
+	keyPool.mu.Unlock()
+	if store == nil {
+		return errors.New("key store is not open")
+	}
+
+	var key []byte
+	if cfg.Secret != "" {
+		sum := sha256.Sum256([]byte(cfg.Secret))
+		key = sum[:]
+	} else {
+		var err error
+		if key, err = loadAccountKey(cfg.KeyFile); err != nil {
+			return err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("failed to create account cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create account cipher: %w", err)
+	}
+
+	records, err := store.loadAccounts()
+	if err != nil {
+		return err
+	}
+	m := newAccountManager(store, aead)
+	for _, rec := range records {
+		m.accounts[rec.ID] = rec
+	}
+	accountPool = m
+	log.Printf("Loaded %d NovelAI accounts", len(records))
+	return nil
+}
+
+// loadAccountKey 读取十六进制保存的 32 字节加密密钥，文件不存在时生成一个新的
+func loadAccountKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate account key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create account key directory: %w", err)
+		}
+		if err := writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write account key %s: %w", path, err)
+		}
+		log.Printf("Generated account encryption key %s, keep it together with the key store", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read account key %s: %w", path, err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("account key %s must be 32 bytes in hex", path)
+	}
+	return key, nil
+}
+
+// normalizeEmail 去掉首尾空白并转为小写，官方客户端计算 access key 前也会这样处理
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// accountID 返回账号的短 id
+func accountID(email string) string {
+	return keyID("account:" + email)
+}
+
+// accessKey 按官方客户端的方式由邮箱和密码计算登录用的 access key：
+// 盐为 blake2b-128(密码前 6 个字符 + 邮箱 + 域名)，对密码做 argon2id
+// (2 次迭代、约 2MB 内存、单线程、64 字节输出)，取 base64url 编码的前 64 个字符
+func accessKey(email, password string) (string, error) {
+	prefix := []rune(password)
+	if len(prefix) > 6 {
+		prefix = prefix[:6]
+	}
+	hash, err := blake2b.New(16, nil)
+	if err != nil {
+		return "", err
+	}
+	hash.Write([]byte(string(prefix) + email + accessKeyDomain))
+	salt := hash.Sum(nil)
+
+	raw := argon2.IDKey([]byte(password), salt, 2, 2000000/1024, 1, 64)
+	return base64.URLEncoding.EncodeToString(raw)[:64], nil
+}
+
+// loginAccount 使用邮箱和密码登录 NovelAI，返回访问令牌，非 2xx 响应以 *upstreamError 返回
+func loginAccount(ctx context.Context, email, password string) (string, error) {
+	key, err := accessKey(email, password)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive access key: %w", err)
+	}
+	payload, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, GetConfig().NovelAI.APIURL+novelAILoginPath, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create new request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", &upstreamError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	var login struct {
+		AccessToken string `json:"accessToken"`
+	}
+	if err := json.Unmarshal(body, &login); err != nil {
+		return "", fmt.Errorf("failed to parse login response: %w", err)
+	}
+	if login.AccessToken == "" {
+		return "", errors.New("login response has no accessToken")
+	}
+	return login.AccessToken, nil
+}
+
+// tokenExpiry 返回 JWT 令牌的过期时间，不是 JWT 或没有 exp 时返回零值
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.Exp), 0)
+}
+
+// encrypt 加密密码
+func (m *accountManager) encrypt(password string) (string, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(m.aead.Seal(nonce, nonce, []byte(password), nil)), nil
+}
+
+// decrypt 解密密码，加密密钥变化后会失败
+func (m *accountManager) decrypt(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < m.aead.NonceSize() {
+		return "", errors.New("failed to decrypt password: malformed ciphertext")
+	}
+	nonce, ciphertext := data[:m.aead.NonceSize()], data[m.aead.NonceSize():]
+	password, err := m.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt password: the accounts secret or key file has changed")
+	}
+	return string(password), nil
+}
+
+// List 返回所有账号，按邮箱排列
+func (m *accountManager) List() []AccountView {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	views := make([]AccountView, 0, len(m.accounts))
+	for _, rec := range m.accounts {
+		views = append(views, rec.view())
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Email < views[j].Email })
+	return views
+}
+
+// Add 登录账号，成功后保存账号并把令牌加入秘钥池，登录失败时不保存
+func (m *accountManager) Add(ctx context.Context, email, password, label string) (*AccountView, error) {
+	if m.store == nil {
+		return nil, errors.New("accounts are not initialized")
+	}
+	email = normalizeEmail(email)
+	id := accountID(email)
+
+	m.mu.Lock()
+	_, exists := m.accounts[id]
+	m.mu.Unlock()
+	if exists {
+		return nil, ErrAccountExists
+	}
+
+	token, err := loginAccount(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := m.encrypt(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt password: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.accounts[id]; exists {
+		return nil, ErrAccountExists
+	}
+	now := time.Now()
+	rec := &AccountRecord{
+		ID:        id,
+		Email:     email,
+		Password:  encrypted,
+		Label:     label,
+		Token:     token,
+		ExpiresAt: tokenExpiry(token),
+		AddedAt:   now,
+		LoginAt:   now,
+	}
+	if err := m.store.putAccount(rec); err != nil {
+		return nil, fmt.Errorf("failed to save account: %w", err)
+	}
+	if err := keyPool.replaceAccountToken("", token, email, label); err != nil {
+		return nil, err
+	}
+	m.accounts[id] = rec
+	log.Printf("Added NovelAI account %s, key %s", email, maskSecret(token))
+	v := rec.view()
+	return &v, nil
+}
+
+// Remove 删除账号，同时从秘钥池中删除它的令牌
+func (m *accountManager) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := m.accounts[id]
+	if rec == nil {
+		return ErrAccountNotFound
+	}
+	if err := m.store.deleteAccount(id); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+	delete(m.accounts, id)
+	delete(m.nextTry, id)
+	if rec.Token != "" {
+		if _, err := keyPool.Remove(rec.Token); err != nil {
+			return err
+		}
+	}
+	log.Printf("Removed NovelAI account %s", rec.Email)
+	return nil
+}
+
+// Relogin 立即重新登录账号，成功后用新令牌替换秘钥池中的旧令牌
+func (m *accountManager) Relogin(ctx context.Context, id string) (*AccountView, error) {
+	if err := m.relogin(ctx, id, "requested by admin"); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec := m.accounts[id]
+	if rec == nil {
+		return nil, ErrAccountNotFound
+	}
+	v := rec.view()
+	return &v, nil
+}
+
+// relogin 重新登录账号，同一账号同时只登录一次，正在登录时直接返回
+// 失败时记录原因，accountRetryInterval 之后才会自动重试
+func (m *accountManager) relogin(ctx context.Context, id, reason string) error {
+	m.mu.Lock()
+	rec := m.accounts[id]
+	if rec == nil {
+		m.mu.Unlock()
+		return ErrAccountNotFound
+	}
+	if m.relogging[id] {
+		m.mu.Unlock()
+		return nil
+	}
+	m.relogging[id] = true
+	email, encrypted := rec.Email, rec.Password
+	m.mu.Unlock()
+
+	// 登录可能需要几秒，期间不持有锁
+	password, err := m.decrypt(encrypted)
+	var token string
+	if err == nil {
+		token, err = loginAccount(ctx, email, password)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.relogging, id)
+	if rec = m.accounts[id]; rec == nil {
+		// 登录期间账号被删除
+		return ErrAccountNotFound
+	}
+
+	updated := *rec
+	now := time.Now()
+	if err != nil {
+		updated.LastError = err.Error()
+		m.nextTry[id] = now.Add(accountRetryInterval)
+		if saveErr := m.store.putAccount(&updated); saveErr != nil {
+			log.Printf("Failed to save account %s: %v", email, saveErr)
+		} else {
+			m.accounts[id] = &updated
+		}
+		log.Printf("Failed to log in NovelAI account %s (%s): %v", email, reason, err)
+		return err
+	}
+
+	if err := keyPool.replaceAccountToken(rec.Token, token, email, rec.Label); err != nil {
+		return err
+	}
+	updated.Token, updated.ExpiresAt = token, tokenExpiry(token)
+	updated.LoginAt, updated.LastError = now, ""
+	delete(m.nextTry, id)
+	if err := m.store.putAccount(&updated); err != nil {
+		return fmt.Errorf("failed to save account: %w", err)
+	}
+	m.accounts[id] = &updated
+	log.Printf("Logged in NovelAI account %s (%s), key %s", email, reason, maskSecret(token))
+	return nil
+}
+
+// dueLocked 返回需要重新登录的账号：没有令牌或令牌即将过期，且不在失败重试的等待期内，调用方需持有 mu
+func (m *accountManager) dueLocked(now time.Time, refreshBefore time.Duration) []string {
+	var ids []string
+	for id, rec := range m.accounts {
+		if now.Before(m.nextTry[id]) {
+			continue
+		}
+		if rec.Token == "" || (!rec.ExpiresAt.IsZero() && rec.ExpiresAt.Sub(now) < refreshBefore) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// onUnauthorized 在令牌返回 401 时后台重新登录它所属的账号，不属于任何账号的令牌忽略
+// 刚登录得到的令牌仍然 401 时不再重复登录，交给秘钥池的隔离与探测处理
+func (m *accountManager) onUnauthorized(token string) {
+	m.mu.Lock()
+	var id string
+	now := time.Now()
+	for _, rec := range m.accounts {
+		if rec.Token == token && now.Sub(rec.LoginAt) >= accountLoginGrace && !now.Before(m.nextTry[rec.ID]) {
+			id = rec.ID
+			break
+		}
+	}
+	m.mu.Unlock()
+	if id == "" {
+		return
+	}
+	go m.relogin(context.Background(), id, "key unauthorized")
+}
+
+// StartAccountRefresher 启动后台任务，在令牌过期前（accounts.refresh_before）自动重新登录账号
+func StartAccountRefresher(ctx context.Context) {
+	go func() {
+		for {
+			m := accountPool
+			m.mu.Lock()
+			ids := m.dueLocked(time.Now(), GetConfig().Accounts.RefreshBefore)
+			m.mu.Unlock()
+			for _, id := range ids {
+				if ctx.Err() != nil {
+					return
+				}
+				m.relogin(ctx, id, "key expiring")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(accountCheckInterval):
+			}
+		}
+	}()
+}
+
+// replaceAccountToken 用账号新登录得到的令牌替换旧令牌，保留旧令牌的选项与位置
+// 旧令牌在失效列表中时，新令牌重新加入可用列表；旧令牌不在池中时追加到可用列表末尾
+func (p *KeyPool) replaceAccountToken(old, token, owner, label string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := append([]*poolKey(nil), p.keys...)
+	disabled := append([]*poolKey(nil), p.disabled...)
+	switch i, j := indexKey(keys, old), indexKey(disabled, old); {
+	case indexKey(keys, token) >= 0:
+		// 令牌没有变化，或新令牌已经在池中
+		if old != token {
+			keys = withoutKeys(keys, []string{old})
+		}
+	case old != "" && i >= 0:
+		key := *keys[i]
+		key.Token = token
+		keys[i] = &key
+	case old != "" && j >= 0:
+		key := *disabled[j]
+		key.Token = token
+		keys = append(keys, &key)
+	default:
+		keys = append(keys, &poolKey{Token: token, Owner: owner, Label: label})
+	}
+	disabled = withoutKeys(disabled, []string{old, token})
+
+	if err := p.saveLocked(keys, disabled, ""); err != nil {
+		return err
+	}
+	p.setListsLocked(keys, disabled)
+	return nil
+}
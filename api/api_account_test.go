@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessKey(t *testing.T) {
+	// 期望值由按同一算法独立编写的参考实现（blake2b-128 盐 + RFC 9106 argon2id）计算得到
+	tests := []struct {
+		email, password string
+		want            string
+	}{
+		{
+			email:    "test@example.com",
+			password: "correct horse battery staple",
+			want:     "-rRTA54TEApfxWczoIupaAfBQ7C4frlPnZ5roUe29THxdTHwDm-TZvHckOQObcHu",
+		},
+		{
+			// 盐取密码的前 6 个字符而不是前 6 个字节
+			email:    "user@novelai.net",
+			password: "密码password123",
+			want:     "01oXWLXPuu4LxqsJdeI3MlGOGzgwIqz2VWFngA_X9_KkWFfZkgM-iP85WoR4B1Id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			got, err := accessKey(tt.email, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("accessKey(%q, %q) = %s, want %s", tt.email, tt.password, got, tt.want)
+			}
+		})
+	}
+
+	// 调用方负责规范化邮箱，大小写不同会得到不同的 access key
+	upper, err := accessKey("Test@Example.com", tests[0].password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper == tests[0].want {
+		t.Error("accessKey ignores the case of the email")
+	}
+	if normalizeEmail(" Test@Example.com ") != tests[0].email {
+		t.Errorf("normalizeEmail did not lower-case and trim the email")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	header := `{"alg":"HS256","typ":"JWT"}`
+	tests := []struct {
+		name  string
+		token string
+		want  time.Time
+	}{
+		{name: "JWT with exp", token: testJWT(header, `{"exp":1700000000}`), want: time.Unix(1700000000, 0)},
+		{name: "fractional exp", token: testJWT(header, `{"exp":1700000000.9}`), want: time.Unix(1700000000, 0)},
+		{name: "no exp", token: testJWT(header, `{"id":"x"}`)},
+		{name: "persistent token", token: "pst-abcdef"},
+		{name: "broken payload", token: "a.b.c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenExpiry(tt.token); !got.Equal(tt.want) {
+				t.Errorf("tokenExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestAccountManager 创建一个使用给定加密密钥的账号管理器
+func newTestAccountManager(t *testing.T, key byte) *accountManager {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAccountManager(nil, aead)
+}
+
+func TestAccountPasswordEncryption(t *testing.T) {
+	m := newTestAccountManager(t, 1)
+
+	encrypted, err := m.encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted == again {
+		t.Error("encrypting the same password twice gave the same ciphertext")
+	}
+	if got, err := m.decrypt(encrypted); err != nil || got != "hunter2" {
+		t.Errorf("decrypt() = %q, %v, want hunter2", got, err)
+	}
+
+	if _, err := newTestAccountManager(t, 2).decrypt(encrypted); err == nil {
+		t.Error("decrypt with a different key succeeded")
+	}
+	if _, err := m.decrypt("not base64!"); err == nil {
+		t.Error("decrypt of malformed ciphertext succeeded")
+	}
+}
+
+func TestLoginAccount(t *testing.T) {
+	const email, password = "test@example.com", "correct horse battery staple"
+	wantKey, err := accessKey(email, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		want       string
+		wantStatus int // 期望的 upstreamError 状态码，0 表示不是上游错误
+		wantErr    bool
+	}{
+		{name: "created", status: http.StatusCreated, body: `{"accessToken":"token-201"}`, want: "token-201"},
+		{name: "ok", status: http.StatusOK, body: `{"accessToken":"token-200"}`, want: "token-200"},
+		{name: "wrong password", status: http.StatusUnauthorized, body: `{"message":"Access Key is incorrect."}`, wantStatus: http.StatusUnauthorized, wantErr: true},
+		{name: "no token", status: http.StatusCreated, body: `{}`, wantErr: true},
+		{name: "not JSON", status: http.StatusCreated, body: `<html>`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Key string `json:"key"`
+				}
+				if r.Method != http.MethodPost || r.URL.Path != "/user/login" {
+					t.Errorf("request = %s %s, want POST /user/login", r.Method, r.URL.Path)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key != wantKey {
+					t.Errorf("login key = %q, %v, want %q", req.Key, err, wantKey)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			useTestConfig(t, func(c *Config) { c.NovelAI.APIURL = srv.URL })
+
+			got, err := loginAccount(context.Background(), email, password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loginAccount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("loginAccount() = %q, want %q", got, tt.want)
+			}
+			var upstream *upstreamError
+			if isUpstream := errors.As(err, &upstream); isUpstream != (tt.wantStatus != 0) || (isUpstream && upstream.Status != tt.wantStatus) {
+				t.Errorf("loginAccount() error = %#v, want upstream status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AccountRequest 用于添加 NovelAI 账号
+type AccountRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Label    string `json:"label"`
+}
+
+// AccountsResponse 用于返回所有账号
+type AccountsResponse struct {
+	Accounts []AccountView `json:"accounts"`
+}
+
+// HandleAccounts 列出 (GET) 或添加 (POST) NovelAI 账号
+// 添加时先登录，登录成功才保存账号，得到的令牌加入秘钥池
+func HandleAccounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, AccountsResponse{Accounts: accountPool.List()})
+	case http.MethodPost:
+		handleAddAccount(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAddAccount 登录并保存账号
+func handleAddAccount(w http.ResponseWriter, r *http.Request) {
+	var req AccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	email := normalizeEmail(req.Email)
+	if email == "" || !strings.Contains(email, "@") || strings.ContainsAny(email, " \t\r\n") {
+		http.Error(w, "a valid email is required", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "password is required", http.StatusBadRequest)
+		return
+	}
+	// 备注会写入秘钥文件的 label= 选项
+	if strings.ContainsAny(req.Label, " \t\r\n") {
+		http.Error(w, "label must not contain spaces", http.StatusBadRequest)
+		return
+	}
+
+	account, err := accountPool.Add(r.Context(), email, req.Password, req.Label)
+	var upErr *upstreamError
+	switch {
+	case errors.Is(err, ErrAccountExists):
+		http.Error(w, fmt.Sprintf("Account %s already exists", email), http.StatusConflict)
+	case errors.As(err, &upErr):
+		http.Error(w, fmt.Sprintf("NovelAI login failed: %v", err), http.StatusBadGateway)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to add account: %v", err), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, account)
+	}
+}
+
+// HandleAccount 按 id 管理单个账号
+// DELETE /accounts/{id} 删除账号及其令牌，POST /accounts/{id}/login 立即重新登录
+func HandleAccount(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/accounts/"), "/")
+	if id == "" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	var account *AccountView
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		err = accountPool.Remove(id)
+	case action == "login" && r.Method == http.MethodPost:
+		account, err = accountPool.Relogin(r.Context(), id)
+	case action == "" || action == "login":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var upErr *upstreamError
+	switch {
+	case errors.Is(err, ErrAccountNotFound):
+		http.Error(w, fmt.Sprintf("Account %s not found", id), http.StatusNotFound)
+	case errors.As(err, &upErr):
+		http.Error(w, fmt.Sprintf("NovelAI login failed: %v", err), http.StatusBadGateway)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to update account: %v", err), http.StatusInternalServerError)
+	case account != nil:
+		writeJSON(w, http.StatusOK, account)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
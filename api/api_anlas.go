@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// free_only 模式，对应配置项 pool.free_only
+const (
+	freeOnlyOff       = "off"       // 允许扣点的请求
+	freeOnlyReject    = "reject"    // 拒绝会扣点的请求
+	freeOnlyDowngrade = "downgrade" // 把会扣点的请求降级为不扣点的参数
+)
+
+// freeOnlyModes 列出所有支持的 free_only 模式
+var freeOnlyModes = []string{freeOnlyOff, freeOnlyReject, freeOnlyDowngrade}
+
+// Opus 订阅不扣点的上限：单张、不超过 28 步、分辨率不超过 1024x1024
+const (
+	opusTier           = 3
+	opusFreeMaxSteps   = 28
+	opusFreeMaxPixels  = 1024 * 1024
+	opusFreeMaxSamples = 1
+)
+
+// anlasCost 是一次画图请求的点数估算
+type anlasCost struct {
+	PerImage     int  // 每张图片消耗的点数
+	Images       int  // 图片张数
+	OpusFreeSize bool // 分辨率与步数在 Opus 免费范围内，此时第一张图片不扣点
+}
+
+// estimateCost 按 NovelAI 网页端的公式估算 V3 模型的点数消耗，结果只是估算值
+func estimateCost(payload map[string]interface{}) anlasCost {
+	params, _ := payload["parameters"].(map[string]interface{})
+	width := numberParam(params, "width")
+	height := numberParam(params, "height")
+	steps := numberParam(params, "steps")
+	samples := int(numberParam(params, "n_samples"))
+	if samples < 1 {
+		samples = 1
+	}
+
+	pixels := width * height
+	perImage := math.Ceil(2.951823174884865e-6*pixels + 5.753298233447344e-7*pixels*steps)
+	switch {
+	case boolParam(params, "sm_dyn"):
+		perImage *= 1.4
+	case boolParam(params, "sm"):
+		perImage *= 1.2
+	}
+	// 图生图按强度折算，最少 2 点
+	if payload["action"] == "img2img" {
+		strength := numberParam(params, "strength")
+		perImage = math.Max(math.Ceil(perImage*strength), 2)
+	}
+
+	return anlasCost{
+		PerImage:     int(math.Ceil(perImage)),
+		Images:       samples,
+		OpusFreeSize: pixels <= opusFreeMaxPixels && steps <= opusFreeMaxSteps,
+	}
+}
+
+// forTier 返回该订阅等级下实际消耗的点数
+func (c anlasCost) forTier(tier int) int {
+	if tier == opusTier && c.OpusFreeSize {
+		return c.PerImage * (c.Images - opusFreeMaxSamples)
+	}
+	return c.PerImage * c.Images
+}
+
+// freeForOpus 判断请求对 Opus 订阅是否不扣点
+func (c anlasCost) freeForOpus() bool {
+	return c.forTier(opusTier) == 0
+}
+
+// applyCostPolicy 按 pool.free_only 处理会扣点的请求，downgrade 模式会直接修改 payload
+// 返回（降级后的）点数估算
+func applyCostPolicy(config *Config, payload map[string]interface{}) (anlasCost, *APIError) {
+	cost := estimateCost(payload)
+	if cost.freeForOpus() || config.Pool.FreeOnly == freeOnlyOff {
+		return cost, nil
+	}
+
+	if config.Pool.FreeOnly == freeOnlyReject {
+		return cost, newAPIError(http.StatusBadRequest, "invalid_request_error", "paid_request_rejected", "",
+			fmt.Sprintf("This request would cost about %d Anlas, but this server only allows free generations "+
+				"(1 image, at most %d steps and 1024x1024 pixels).", cost.forTier(opusTier), opusFreeMaxSteps))
+	}
+
+	params := payload["parameters"].(map[string]interface{})
+	width, height := numberParam(params, "width"), numberParam(params, "height")
+	if pixels := width * height; pixels > opusFreeMaxPixels {
+		// 保持宽高比缩小到 1024x1024 像素以内，宽高仍为 64 的倍数
+		scale := math.Sqrt(opusFreeMaxPixels / pixels)
+		params["width"] = int(math.Max(64, math.Floor(width*scale/64)*64))
+		params["height"] = int(math.Max(64, math.Floor(height*scale/64)*64))
+	}
+	if numberParam(params, "steps") > opusFreeMaxSteps {
+		params["steps"] = opusFreeMaxSteps
+	}
+	params["n_samples"] = opusFreeMaxSamples
+
+	downgraded := estimateCost(payload)
+	log.Printf("Downgraded paid request (about %d Anlas) to %vx%v, %v steps, 1 image",
+		cost.forTier(opusTier), params["width"], params["height"], params["steps"])
+	return downgraded, nil
+}
+
+// affordableLocked 判断秘钥能否承担本次请求，cost 为 nil 或对 Opus 免费的请求任何秘钥都可以
+// 扣点的请求只交给记录的剩余点数足够的秘钥；还没有检查过订阅信息的秘钥不知道点数，
+// 要等健康检查记录之后才会用于扣点的请求。调用方需持有 mu
+func (p *KeyPool) affordableLocked(key string, cost *anlasCost) bool {
+	if cost == nil || cost.freeForOpus() {
+		return true
+	}
+	info := p.info[key]
+	return info != nil && info.Anlas >= cost.forTier(info.Tier)
+}
+
+// anyAffordableLocked 判断是否有任何非隔离秘钥能承担本次请求，调用方需持有 mu
+func (p *KeyPool) anyAffordableLocked(cost *anlasCost) bool {
+	for _, key := range p.keys {
+		if st := p.status[key.Token]; st != nil && st.State == keyQuarantined {
+			continue
+		}
+		if p.affordableLocked(key.Token, cost) {
+			return true
+		}
+	}
+	return false
+}
+
+// SpendAnlas 在请求成功后从记录的剩余点数中扣除估算的消耗，直到下一次健康检查更新
+func (p *KeyPool) SpendAnlas(key string, cost anlasCost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if info := p.info[key]; info != nil {
+		updated := *info
+		updated.Anlas = max(0, info.Anlas-cost.forTier(info.Tier))
+		p.info[key] = &updated
+	}
+}
+
+// MarkNoAnlas 在 NovelAI 返回 402 后将秘钥记录的剩余点数清零，之后的扣点请求不再选中它
+func (p *KeyPool) MarkNoAnlas(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	updated := KeyInfo{}
+	if info := p.info[key]; info != nil {
+		updated = *info
+	}
+	updated.Anlas = 0
+	p.info[key] = &updated
+}
+
+// numberParam 读取数值参数，兼容 int 与配置文件中解析出的 float64
+func numberParam(params map[string]interface{}, name string) float64 {
+	switch v := params[name].(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
+
+// boolParam 读取布尔参数
+func boolParam(params map[string]interface{}, name string) bool {
+	v, _ := params[name].(bool)
+	return v
+}
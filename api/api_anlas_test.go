@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// testPayload 构造只包含点数估算所需参数的画图请求
+func testPayload(width, height, steps, samples int, extra map[string]interface{}) map[string]interface{} {
+	params := map[string]interface{}{
+		"width":     width,
+		"height":    height,
+		"steps":     steps,
+		"n_samples": samples,
+	}
+	payload := map[string]interface{}{"action": "generate", "parameters": params}
+	for name, value := range extra {
+		if name == "action" {
+			payload[name] = value
+			continue
+		}
+		params[name] = value
+	}
+	return payload
+}
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  map[string]interface{}
+		perImage int
+		opusCost int // Opus 订阅实际消耗的点数
+		otherFee int // 其他订阅实际消耗的点数
+	}{
+		{name: "portrait within the Opus limits", payload: testPayload(832, 1216, 28, 1, nil), perImage: 20, opusCost: 0, otherFee: 20},
+		{name: "second image is paid for Opus", payload: testPayload(832, 1216, 28, 2, nil), perImage: 20, opusCost: 20, otherFee: 40},
+		{name: "too many pixels", payload: testPayload(1024, 1536, 28, 1, nil), perImage: 30, opusCost: 30, otherFee: 30},
+		{name: "too many steps", payload: testPayload(832, 1216, 50, 1, nil), perImage: 33, opusCost: 33, otherFee: 33},
+		{name: "SMEA", payload: testPayload(832, 1216, 28, 1, map[string]interface{}{"sm": true}), perImage: 24, opusCost: 0, otherFee: 24},
+		{name: "SMEA DYN", payload: testPayload(832, 1216, 28, 1, map[string]interface{}{"sm": true, "sm_dyn": true}), perImage: 28, opusCost: 0, otherFee: 28},
+		{
+			name:     "img2img scales with strength",
+			payload:  testPayload(832, 1216, 28, 1, map[string]interface{}{"action": "img2img", "strength": 0.5}),
+			perImage: 10, opusCost: 0, otherFee: 10,
+		},
+		{
+			name:     "img2img costs at least 2",
+			payload:  testPayload(512, 512, 10, 1, map[string]interface{}{"action": "img2img", "strength": 0.1}),
+			perImage: 2, opusCost: 0, otherFee: 2,
+		},
+		{name: "config values are float64", payload: testPayload(832, 1216, 28, 1, map[string]interface{}{"steps": 28.0}), perImage: 20, opusCost: 0, otherFee: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost := estimateCost(tt.payload)
+			if cost.PerImage != tt.perImage {
+				t.Errorf("PerImage = %d, want %d", cost.PerImage, tt.perImage)
+			}
+			if got := cost.forTier(opusTier); got != tt.opusCost {
+				t.Errorf("Opus cost = %d, want %d", got, tt.opusCost)
+			}
+			if got := cost.forTier(1); got != tt.otherFee {
+				t.Errorf("Tablet cost = %d, want %d", got, tt.otherFee)
+			}
+		})
+	}
+}
+
+func TestApplyCostPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		freeOnly   string
+		payload    map[string]interface{}
+		wantErr    bool
+		wantParams map[string]int // 处理后的参数，nil 表示不修改
+	}{
+		{name: "free request is never touched", freeOnly: freeOnlyReject, payload: testPayload(832, 1216, 28, 1, nil)},
+		{name: "paid request allowed when off", freeOnly: freeOnlyOff, payload: testPayload(1024, 1536, 28, 2, nil)},
+		{name: "paid request rejected", freeOnly: freeOnlyReject, payload: testPayload(1024, 1536, 28, 1, nil), wantErr: true},
+		{
+			name:       "paid request downgraded",
+			freeOnly:   freeOnlyDowngrade,
+			payload:    testPayload(1216, 1856, 40, 2, nil),
+			wantParams: map[string]int{"width": 768, "height": 1216, "steps": 28, "n_samples": 1},
+		},
+		{
+			name:       "downgrade keeps free dimensions",
+			freeOnly:   freeOnlyDowngrade,
+			payload:    testPayload(832, 1216, 28, 3, nil),
+			wantParams: map[string]int{"width": 832, "height": 1216, "steps": 28, "n_samples": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := useTestConfig(t, func(c *Config) { c.Pool.FreeOnly = tt.freeOnly })
+			params := tt.payload["parameters"].(map[string]interface{})
+			before := make(map[string]interface{})
+			for name, value := range params {
+				before[name] = value
+			}
+
+			cost, apiErr := applyCostPolicy(config, tt.payload)
+			if (apiErr != nil) != tt.wantErr {
+				t.Fatalf("applyCostPolicy() error = %v, wantErr %v", apiErr, tt.wantErr)
+			}
+			if apiErr != nil && apiErr.Code != "paid_request_rejected" {
+				t.Errorf("error code = %q, want paid_request_rejected", apiErr.Code)
+			}
+
+			if tt.wantParams == nil {
+				for name, value := range before {
+					if params[name] != value {
+						t.Errorf("%s changed from %v to %v", name, value, params[name])
+					}
+				}
+				return
+			}
+			for name, want := range tt.wantParams {
+				if got := numberParam(params, name); got != float64(want) {
+					t.Errorf("%s = %v, want %d", name, got, want)
+				}
+			}
+			if !cost.freeForOpus() {
+				t.Errorf("downgraded request still costs %d Anlas", cost.forTier(opusTier))
+			}
+		})
+	}
+}
+
+func TestAcquireRoutesPaidRequests(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.Pool.Strategy = strategyRoundRobin })
+	paid := estimateCost(testPayload(1024, 1536, 28, 1, nil)) // 30 点
+	free := estimateCost(testPayload(832, 1216, 28, 1, nil))
+
+	tests := []struct {
+		name    string
+		info    map[string]*KeyInfo
+		cost    *anlasCost
+		want    string
+		wantErr error
+	}{
+		{
+			name: "free request uses any key",
+			info: map[string]*KeyInfo{"a": {Tier: opusTier, Anlas: 0}},
+			cost: &free,
+			want: "a",
+		},
+		{
+			name: "paid request skips keys without enough Anlas",
+			info: map[string]*KeyInfo{"a": {Tier: opusTier, Anlas: 29}, "b": {Tier: 1, Anlas: 30}},
+			cost: &paid,
+			want: "b",
+		},
+		{
+			name: "free request uses keys that were never checked",
+			info: map[string]*KeyInfo{},
+			cost: &free,
+			want: "a",
+		},
+		{
+			name: "paid request skips keys that were never checked",
+			info: map[string]*KeyInfo{"b": {Tier: 1, Anlas: 30}},
+			cost: &paid,
+			want: "b",
+		},
+		{
+			name:    "paid request with no checked keys",
+			info:    map[string]*KeyInfo{},
+			cost:    &paid,
+			wantErr: ErrInsufficientAnlas,
+		},
+		{
+			name:    "no key can afford the request",
+			info:    map[string]*KeyInfo{"a": {Tier: opusTier, Anlas: 10}, "b": {Tier: 1, Anlas: 0}},
+			cost:    &paid,
+			wantErr: ErrInsufficientAnlas,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool("a", "b")
+			p.info = tt.info
+			got, err := p.Acquire(context.Background(), AcquireOptions{Cost: tt.cost})
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("Acquire() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSpendAndMarkNoAnlas(t *testing.T) {
+	p := newTestPool("a")
+	p.info = map[string]*KeyInfo{"a": {Tier: 1, Anlas: 50}}
+	cost := estimateCost(testPayload(1024, 1536, 28, 1, nil))
+
+	p.SpendAnlas("a", cost)
+	if got := p.info["a"].Anlas; got != 20 {
+		t.Errorf("Anlas after spending = %d, want 20", got)
+	}
+	p.SpendAnlas("a", cost)
+	if got := p.info["a"].Anlas; got != 0 {
+		t.Errorf("Anlas after overspending = %d, want 0", got)
+	}
+
+	p.MarkNoAnlas("b")
+	if info := p.info["b"]; info == nil || info.Anlas != 0 {
+		t.Errorf("MarkNoAnlas on an unchecked key = %+v", info)
+	}
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// masterClientName 是使用 sk.key 调用时的调用方名称，不受额度限制
+const masterClientName = "default"
+
+// ClientKey 定义一个调用方的 API key 及其限制
+type ClientKey struct {
+	Name           string      `json:"name"`
+	Key            string      `json:"key"`
+	Models         []string    `json:"models"`          // 允许使用的模型 id，为空表示全部
+	DailyQuota     int         `json:"daily_quota"`     // 每日图片额度，0 表示不限
+	MonthlyQuota   int         `json:"monthly_quota"`   // 每月图片额度，0 表示不限
+	MaxConcurrency int         `json:"max_concurrency"` // 最大并发请求数，0 表示不限
+	RateLimitRPM   int         `json:"rate_limit_rpm"`  // 每分钟请求数，0 表示使用 clients.rate_limit_rpm，-1 表示不限
+	Enabled        bool        `json:"enabled"`
+	CreatedAt      time.Time   `json:"created_at"`
+	Usage          ClientUsage `json:"usage"`
+}
+
+// ClientUsage 记录调用方已经生成的图片数量
+type ClientUsage struct {
+	Day        string `json:"day"` // 2006-01-02
+	DayCount   int    `json:"day_count"`
+	Month      string `json:"month"` // 2006-01
+	MonthCount int    `json:"month_count"`
+	Total      int    `json:"total"`
+}
+
+// roll 在跨天、跨月时清零对应的计数
+func (u *ClientUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayCount = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthCount = month, 0
+	}
+}
+
+// clientRegistry 保存所有调用方，并负责持久化到磁盘
+type clientRegistry struct {
+	mu      sync.Mutex
+	path    string
+	clients map[string]*ClientKey   // name => client
+	active  map[string]int          // name => 进行中的请求数
+	pending map[string]int          // name => 已预留但尚未完成的图片数
+	buckets map[string]*tokenBucket // name => 限流令牌桶
+}
+
+// clients 是全局的调用方注册表，由 InitClients 初始化
+var clients = &clientRegistry{
+	clients: make(map[string]*ClientKey),
+	active:  make(map[string]int),
+	pending: make(map[string]int),
+	buckets: make(map[string]*tokenBucket),
+}
+
+// InitClients 从磁盘加载调用方注册表，文件不存在时视为空表
+func InitClients(path string) error {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	clients.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read clients file %s: %w", path, err)
+	}
+
+	var list []*ClientKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse clients file %s: %w", path, err)
+	}
+	for _, client := range list {
+		clients.clients[client.Name] = client
+	}
+	log.Printf("Loaded %d client keys from %s", len(list), path)
+	return nil
+}
+
+// saveLocked 将注册表写回磁盘，调用方需持有 mu
+func (c *clientRegistry) saveLocked() error {
+	list := make([]*ClientKey, 0, len(c.clients))
+	for _, client := range c.clients {
+		list = append(list, client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal clients: %w", err)
+	}
+	return writeFileAtomic(c.path, data, 0600)
+}
+
+// findByKeyLocked 按 key 查找调用方，调用方需持有 mu
+func (c *clientRegistry) findByKeyLocked(key string) *ClientKey {
+	for _, client := range c.clients {
+		if subtle.ConstantTimeCompare([]byte(client.Key), []byte(key)) == 1 {
+			return client
+		}
+	}
+	return nil
+}
+
+// clientSession 表示一次已通过认证的请求对应的调用方
+type clientSession struct {
+	Name   string
+	master bool
+}
+
+// authenticateClient 校验 Authorization 请求头，sk.key 视为不受限的默认调用方
+func authenticateClient(r *http.Request) (*clientSession, *APIError) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil, errInvalidAPIKey()
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(GetConfig().SK.Key)) == 1 {
+		return &clientSession{Name: masterClientName, master: true}, nil
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client := clients.findByKeyLocked(token)
+	if client == nil {
+		return nil, errInvalidAPIKey()
+	}
+	if !client.Enabled {
+		return nil, newAPIError(http.StatusForbidden, "permission_error", "api_key_disabled", "", "This API key has been disabled.")
+	}
+	return &clientSession{Name: client.Name}, nil
+}
+
+// allowsModel 判断调用方是否可以使用该模型
+func (s *clientSession) allowsModel(model string) bool {
+	if s.master {
+		return true
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client := clients.clients[s.Name]
+	if client == nil {
+		return false
+	}
+	if len(client.Models) == 0 {
+		return true
+	}
+	for _, allowed := range client.Models {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModel 在调用方无权使用该模型时返回 403
+func (s *clientSession) checkModel(model string) *APIError {
+	if s.allowsModel(model) {
+		return nil
+	}
+	return newAPIError(http.StatusForbidden, "permission_error", "model_not_allowed", "model", fmt.Sprintf("This API key is not allowed to use the model `%s`", model))
+}
+
+// reserve 检查并发与额度并预留 images 张图片的额度
+// 返回的 release 必须调用一次，generated 为实际生成的张数，最多计入预留的张数
+// （free_only 降级后生成的张数可能少于预留的张数）
+func (s *clientSession) reserve(images int) (release func(generated int), apiErr *APIError) {
+	if s.master {
+		return func(int) {}, nil
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client := clients.clients[s.Name]
+	if client == nil {
+		return nil, errInvalidAPIKey()
+	}
+
+	if client.MaxConcurrency > 0 && clients.active[s.Name] >= client.MaxConcurrency {
+		return nil, newAPIError(http.StatusTooManyRequests, "rate_limit_error", "concurrency_limit_exceeded", "",
+			fmt.Sprintf("Too many concurrent requests for this API key (limit %d).", client.MaxConcurrency))
+	}
+
+	client.Usage.roll(time.Now())
+	pending := clients.pending[s.Name]
+	if client.DailyQuota > 0 && client.Usage.DayCount+pending+images > client.DailyQuota {
+		return nil, newAPIError(http.StatusTooManyRequests, "insufficient_quota", "quota_exceeded", "",
+			fmt.Sprintf("Daily image quota exhausted for this API key (%d/%d used).", client.Usage.DayCount, client.DailyQuota))
+	}
+	if client.MonthlyQuota > 0 && client.Usage.MonthCount+pending+images > client.MonthlyQuota {
+		return nil, newAPIError(http.StatusTooManyRequests, "insufficient_quota", "quota_exceeded", "",
+			fmt.Sprintf("Monthly image quota exhausted for this API key (%d/%d used).", client.Usage.MonthCount, client.MonthlyQuota))
+	}
+
+	clients.active[s.Name]++
+	clients.pending[s.Name] += images
+
+	var once sync.Once
+	return func(generated int) {
+		once.Do(func() { clients.release(s.Name, images, min(generated, images)) })
+	}, nil
+}
+
+// release 释放预留的并发与额度，将实际生成的张数计入用量并保存
+func (c *clientRegistry) release(name string, reserved, generated int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active[name]--
+	c.pending[name] -= reserved
+
+	client := c.clients[name]
+	if generated <= 0 || client == nil {
+		return
+	}
+	client.Usage.roll(time.Now())
+	client.Usage.DayCount += generated
+	client.Usage.MonthCount += generated
+	client.Usage.Total += generated
+	if err := c.saveLocked(); err != nil {
+		log.Printf("保存调用方用量失败: %v", err)
+	}
+}
+
+// generateClientKey 生成一个新的 sk- 前缀的随机 key
+func generateClientKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
+
+// maskSecret 隐藏秘钥中间部分，只保留首尾用于辨认
+func maskSecret(secret string) string {
+	if len(secret) <= 12 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:6] + "..." + secret[len(secret)-4:]
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免写到一半时进程退出导致文件损坏
+// 重命名失败（例如 Docker 单文件挂载）时退回直接覆盖写入
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return os.WriteFile(path, data, perm)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmpName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpName, err)
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return os.WriteFile(path, data, perm)
+	}
+	return nil
+}
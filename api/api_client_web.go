@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClientRequest 用于创建或修改调用方，修改时为 nil 的字段保持不变
+type ClientRequest struct {
+	Name           string    `json:"name"`
+	Key            string    `json:"key"` // 创建时为空则自动生成
+	Models         *[]string `json:"models"`
+	DailyQuota     *int      `json:"daily_quota"`
+	MonthlyQuota   *int      `json:"monthly_quota"`
+	MaxConcurrency *int      `json:"max_concurrency"`
+	RateLimitRPM   *int      `json:"rate_limit_rpm"`
+	Enabled        *bool     `json:"enabled"`
+}
+
+// ClientsResponse 用于返回调用方列表
+type ClientsResponse struct {
+	Clients []ClientKey `json:"clients"`
+}
+
+// HandleClients 管理调用方 API key
+// GET 列出（key 已隐藏），POST 创建，PUT 修改，DELETE ?name= 删除
+func HandleClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleListClients(w)
+	case http.MethodPost, http.MethodPut:
+		handleSaveClient(w, r)
+	case http.MethodDelete:
+		handleDeleteClient(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleListClients 返回所有调用方，key 只显示首尾
+func handleListClients(w http.ResponseWriter) {
+	clients.mu.Lock()
+	list := make([]ClientKey, 0, len(clients.clients))
+	now := time.Now()
+	for _, client := range clients.clients {
+		client.Usage.roll(now)
+		masked := *client
+		masked.Key = maskSecret(client.Key)
+		list = append(list, masked)
+	}
+	clients.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, ClientsResponse{Clients: list})
+}
+
+// handleSaveClient 创建 (POST) 或修改 (PUT) 调用方，创建时返回完整的 key
+func handleSaveClient(w http.ResponseWriter, r *http.Request) {
+	var req ClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || req.Name == masterClientName {
+		http.Error(w, fmt.Sprintf("name is required and must not be %q", masterClientName), http.StatusBadRequest)
+		return
+	}
+	for _, limit := range []*int{req.DailyQuota, req.MonthlyQuota, req.MaxConcurrency} {
+		if limit != nil && *limit < 0 {
+			http.Error(w, "quotas and max_concurrency must not be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.RateLimitRPM != nil && *req.RateLimitRPM < -1 {
+		http.Error(w, "rate_limit_rpm must be -1 (unlimited), 0 (default) or positive", http.StatusBadRequest)
+		return
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client, exists := clients.clients[req.Name]
+	creating := r.Method == http.MethodPost
+	if creating && exists {
+		http.Error(w, fmt.Sprintf("client %q already exists", req.Name), http.StatusConflict)
+		return
+	}
+	if !creating && !exists {
+		http.Error(w, fmt.Sprintf("client %q not found", req.Name), http.StatusNotFound)
+		return
+	}
+
+	if creating {
+		client = &ClientKey{Name: req.Name, Enabled: true, CreatedAt: time.Now()}
+		if req.Key == "" {
+			key, err := generateClientKey()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to generate key: %v", err), http.StatusInternalServerError)
+				return
+			}
+			req.Key = key
+		}
+	}
+	if req.Key != "" {
+		if req.Key == GetConfig().SK.Key {
+			http.Error(w, "key must differ from sk.key", http.StatusBadRequest)
+			return
+		}
+		if other := clients.findByKeyLocked(req.Key); other != nil && other.Name != req.Name {
+			http.Error(w, "key is already used by another client", http.StatusConflict)
+			return
+		}
+	}
+
+	// 先在副本上修改，保存成功后再替换，避免写盘失败时内存与文件不一致
+	updated := *client
+	if req.Key != "" {
+		updated.Key = req.Key
+	}
+	if req.Models != nil {
+		updated.Models = *req.Models
+	}
+	if req.DailyQuota != nil {
+		updated.DailyQuota = *req.DailyQuota
+	}
+	if req.MonthlyQuota != nil {
+		updated.MonthlyQuota = *req.MonthlyQuota
+	}
+	if req.MaxConcurrency != nil {
+		updated.MaxConcurrency = *req.MaxConcurrency
+	}
+	if req.RateLimitRPM != nil {
+		updated.RateLimitRPM = *req.RateLimitRPM
+	}
+	if req.Enabled != nil {
+		updated.Enabled = *req.Enabled
+	}
+
+	clients.clients[req.Name] = &updated
+	if err := clients.saveLocked(); err != nil {
+		if exists {
+			clients.clients[req.Name] = client
+		} else {
+			delete(clients.clients, req.Name)
+		}
+		http.Error(w, fmt.Sprintf("Failed to save clients: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %q saved", req.Name)
+
+	// 只有创建时返回完整的 key
+	resp := updated
+	status := http.StatusCreated
+	if !creating {
+		resp.Key = maskSecret(updated.Key)
+		status = http.StatusOK
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleDeleteClient 删除调用方
+func handleDeleteClient(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client, exists := clients.clients[name]
+	if !exists {
+		http.Error(w, fmt.Sprintf("client %q not found", name), http.StatusNotFound)
+		return
+	}
+	delete(clients.clients, name)
+	if err := clients.saveLocked(); err != nil {
+		clients.clients[name] = client
+		http.Error(w, fmt.Sprintf("Failed to save clients: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %q deleted", name)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Client deleted successfully"))
+}
+
+// writeJSON 以 JSON 格式写出响应
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
+}
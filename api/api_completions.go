@@ -1,63 +1,29 @@
 package api
 
 import (
-	"archive/zip"
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/spf13/viper"
-	"gopkg.in/yaml.v3"
-	"io"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
-	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"time"
 )
 
-// Config 定义配置文件结构体
-type Config struct {
-	Parameters struct {
-		ParamsVersion               int         `yaml:"params_version"`
-		Width                       int         `yaml:"width"`
-		Height                      int         `yaml:"height"`
-		Scale                       int         `yaml:"scale"`
-		Sampler                     string      `yaml:"sampler"`
-		Steps                       int         `yaml:"steps"`
-		NSamples                    int         `yaml:"n_samples"`
-		UCPreset                    int         `yaml:"ucPreset"`
-		QualityToggle               bool        `yaml:"qualityToggle"`
-		SM                          bool        `yaml:"sm"`
-		SMDyn                       bool        `yaml:"sm_dyn"`
-		DynamicThresholding         bool        `yaml:"dynamic_thresholding"`
-		ControlNetStrength          float64     `yaml:"controlnet_strength"`
-		Legacy                      bool        `yaml:"legacy"`
-		AddOriginalImage            bool        `yaml:"add_original_image"`
-		CFGRescale                  int         `yaml:"cfg_rescale"`
-		NoiseSchedule               string      `yaml:"noise_schedule"`
-		LegacyV3Extend              bool        `yaml:"legacy_v3_extend"`
-		SkipCFGAboveSigma           interface{} `yaml:"skip_cfg_above_sigma"`
-		DeliberateEulerAncestralBug bool        `yaml:"deliberate_euler_ancestral_bug"`
-		PreferBrownian              bool        `yaml:"prefer_brownian"`
-	} `yaml:"parameters"`
-}
-
 // Choice 定义响应结构体
+// 流式输出使用 Delta，非流式输出使用 Message
 type Choice struct {
-	Delta        Delta   `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
-	Index        int     `json:"index"`
-	Logprobs     *string `json:"logprobs"`
+	Delta        *Delta   `json:"delta,omitempty"`
+	Message      *Message `json:"message,omitempty"`
+	FinishReason *string  `json:"finish_reason"`
+	Index        int      `json:"index"`
+	Logprobs     *string  `json:"logprobs"`
 }
 
 type Delta struct {
-	Content string  `json:"content"`
+	Content string  `json:"content,omitempty"`
 	Refusal *string `json:"refusal"`
-	Role    string  `json:"role"`
+	Role    string  `json:"role,omitempty"`
 }
 
 type Response struct {
@@ -75,6 +41,8 @@ type ChatRequest struct {
 	Authorization string    `json:"Authorization"`
 	Messages      []Message `json:"messages"`
 	Model         string    `json:"model"`
+	Stream        bool      `json:"stream"`
+	ReferenceMode string    `json:"reference_mode"` // 扩展字段：参考图的用法，vibe_transfer 或 img2img，为空时优先 vibe transfer
 }
 
 type Message struct {
@@ -116,75 +84,24 @@ func extractLinks(userInput string) []string {
 // Completions 处理请求的函数
 func Completions(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
-	// 文件路径
-	filePath := "config.yml"
-
-	//获取配置文件
-	viper.SetConfigFile(filePath)
+	// 整个请求使用同一份配置
+	config := GetConfig()
 
-	// 读取配置文件
-	err := viper.ReadInConfig()
-	if err != nil {
-		fmt.Printf("Error reading config file: %s\n", err)
+	// 如果是 OPTIONS 请求，直接返回 200 OK
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	// 读取配置文件
-	configFile, err := os.Open("config.yml")
-	if err != nil {
-		log.Fatalf("Error opening config file: %v", err)
-	}
-	defer configFile.Close()
-
-	// 解析 YAML 配置文件
-	byteValue, _ := ioutil.ReadAll(configFile)
-	var config Config
-	if err := yaml.Unmarshal(byteValue, &config); err != nil {
-		log.Fatalf("Error parsing config file: %v", err)
-	}
-
-	// 获取配置文件中的参数
-	// 推送程序选择
-	channelName := viper.GetString("channel.name")
-
-	// alist 配置
-	alistDir := viper.GetString("alist.dir")
-	alistUsername := viper.GetString("alist.username")
-	alistPassword := viper.GetString("alist.password")
-
-	// minio 配置
-	minioUrl := viper.GetString("minio.Url")
-	minioAccessKey := viper.GetString("minio.AccessKey")
-	minioSecretKey := viper.GetString("minio.SecretKey")
-	minioBucket := viper.GetString("minio.Bucket")
-	minioAlias := viper.GetString("minio.Alias")
-
-	// 1. 获取 Authorization 请求头的值
-	authHeader := r.Header.Get("Authorization")
-	authHeader = strings.TrimPrefix(authHeader, "Bearer ")
-
-	fmt.Println("传输：", authHeader)
-
-	// 2. 从 Viper 中获取密钥
-	key := viper.GetString("sk.key") // 假设你的配置文件中有类似 sk: { key: "your_secret_key" } 的结构
-
-	fmt.Println("查找：", key)
-
-	// 3. 比较 Authorization 头的值和密钥
-	if authHeader == key {
-		// 认证成功，允许往下走
-		fmt.Println("Authorization successful!")
-	} else {
-		// 认证失败，返回未授权错误
-		fmt.Println("Authorization failed!")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Authentication failed. Unauthorized."))
+	// 校验 Authorization 请求头，确定调用方
+	session, apiErr := authenticateClient(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
-
-	// 如果是 OPTIONS 请求，直接返回 200 OK
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	// 按调用方的每分钟请求数限流
+	if apiErr := session.checkRateLimit(config); apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
 
@@ -192,7 +109,24 @@ func Completions(w http.ResponseWriter, r *http.Request) {
 	var req ChatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("Failed to decode request body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, errBadRequest("", "Invalid request body: %v", err))
+		return
+	}
+
+	// 校验模型，未知模型不转发给 NovelAI
+	model := findModel(config, req.Model)
+	if model == nil {
+		writeError(w, errModelNotFound(req.Model))
+		return
+	}
+	if apiErr := session.checkModel(model.ID); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	if req.ReferenceMode != "" && req.ReferenceMode != referenceVibeTransfer && req.ReferenceMode != referenceImg2Img {
+		writeError(w, errBadRequest("reference_mode", "reference_mode must be %s or %s", referenceVibeTransfer, referenceImg2Img))
+		return
 	}
 
 	// 获取最后一条用户输入
@@ -200,7 +134,6 @@ func Completions(w http.ResponseWriter, r *http.Request) {
 	for i := len(req.Messages) - 1; i >= 0; i-- {
 		if req.Messages[i].Role == "user" {
 			userInput = req.Messages[i].Content
-			log.Printf("User input found: %s", userInput)
 			break
 		}
 	}
@@ -209,254 +142,143 @@ func Completions(w http.ResponseWriter, r *http.Request) {
 	imageURL := extractLinks(userInput)
 	var base64String string
 	if len(imageURL) > 0 {
+		if referenceMode(model, req.ReferenceMode) == "" {
+			if req.ReferenceMode != "" {
+				writeError(w, errBadRequest("reference_mode", "The model `%s` does not support reference_mode %q", req.Model, req.ReferenceMode))
+			} else {
+				writeError(w, errBadRequest("messages", "The model `%s` does not support reference images", req.Model))
+			}
+			return
+		}
 		// 选择第一个提取到的链接
 		imageURLS := imageURL[0]
 		// 解析图片为bash
+		var err error
 		base64String, err = ImageURLToBase64(imageURLS)
 		if err != nil {
-			log.Fatalf("Error: %v", err)
+			log.Printf("[%s] Failed to fetch reference image %s: %v", RequestID(r), imageURLS, err)
+			writeError(w, errBadRequest("messages", "Failed to fetch reference image: %v", err))
+			return
 		}
 	}
 
 	positiveWords, negativeWords := extractWords(userInput)
-	fmt.Println("正词:", positiveWords)
-	fmt.Println("反词:", negativeWords)
-
-	// 生成一个随机种子
-	rand.Seed(time.Now().UnixNano()) // 使用当前时间的纳秒数作为随机数生成器的种子
-	randomSeed := rand.Intn(1000000) // 生成一个0到999999之间的随机数
-
-	// 返回值
-	var resp *http.Response
-	var keys string
-	for i := 0; i < 5; i++ {
-
-		// 获取被锁定的key值
-		falseKeys := GetLockedKeys()
-		fmt.Println("获取锁定的key值列表：", falseKeys)
-
-		// 获取随机密钥
-		keys, err = GetRandomKey(viper.GetString("Nkey.path"), falseKeys)
-		fmt.Println("获取到的随机key：", keys)
-		if err != nil {
-			log.Fatalf("Error getting random key: %v", err)
-		}
-
-		// 创建请求到目标 API
-		apiURL := "https://image.novelai.net/ai/generate-image"
-		log.Println("Preparing payload for API request.")
-		// 支持自定义
-		payload := map[string]interface{}{
-			"input":  positiveWords + ",best quality, amazing quality, very aesthetic, absurdres",
-			"model":  req.Model,
-			"action": "generate",
-			"parameters": map[string]interface{}{
-				"params_version":                 config.Parameters.ParamsVersion,
-				"width":                          config.Parameters.Width,
-				"height":                         config.Parameters.Height,
-				"scale":                          config.Parameters.Scale,
-				"sampler":                        config.Parameters.Sampler,
-				"steps":                          config.Parameters.Steps,
-				"seed":                           randomSeed,
-				"n_samples":                      config.Parameters.NSamples,
-				"ucPreset":                       config.Parameters.UCPreset,
-				"qualityToggle":                  config.Parameters.QualityToggle,
-				"sm":                             config.Parameters.SM,
-				"sm_dyn":                         config.Parameters.SMDyn,
-				"dynamic_thresholding":           config.Parameters.DynamicThresholding,
-				"controlnet_strength":            config.Parameters.ControlNetStrength,
-				"legacy":                         config.Parameters.Legacy,
-				"add_original_image":             config.Parameters.AddOriginalImage,
-				"cfg_rescale":                    config.Parameters.CFGRescale,
-				"noise_schedule":                 config.Parameters.NoiseSchedule,
-				"legacy_v3_extend":               config.Parameters.LegacyV3Extend,
-				"skip_cfg_above_sigma":           config.Parameters.SkipCFGAboveSigma,
-				"negative_prompt":                negativeWords + "pussy, nipples, nude, naked, nsfw, lowres, {bad}, error, fewer, extra, missing, worst quality, jpeg artifacts, bad quality, watermark, unfinished, displeasing, chromatic aberration, signature, extra digits, artistic error, username, scan, [abstract]",
-				"deliberate_euler_ancestral_bug": config.Parameters.DeliberateEulerAncestralBug,
-				"prefer_brownian":                config.Parameters.PreferBrownian,
-			},
-		}
 
-		// 根据是否有有效的 base64String 来决定是否添加这三个字段
-		if base64String != "" {
-			payload["parameters"].(map[string]interface{})["reference_image_multiple"] = []interface{}{base64String}
-			payload["parameters"].(map[string]interface{})["reference_information_extracted_multiple"] = []interface{}{1}
-			payload["parameters"].(map[string]interface{})["reference_strength_multiple"] = []interface{}{0.6}
-		}
+	// 检查调用方的并发与额度，对话画图每次计一张
+	release, apiErr := session.reserve(1)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	generated := 0
+	defer func() { release(generated) }()
 
-		// 将 payload 转换为 JSON
-		payloadBytes, _ := json.Marshal(payload)
-		log.Println("Payload marshaled to JSON")
+	// 记录进行中的任务，服务关闭时会等待其推送完成
+	defer beginGeneration()()
 
-		// 创建新的请求
-		client := &http.Client{}
-		request, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payloadBytes))
+	// 流式请求在生成开始前就发送首个 chunk，并在等待期间保活
+	var stream *sseWriter
+	if req.Stream {
+		var err error
+		stream, err = newSSEWriter(w, req.Model)
 		if err != nil {
-			log.Printf("Failed to create new request: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			// 释放key值
-			ReleaseKey(keys)
+			log.Printf("Failed to create SSE writer: %v", err)
+			writeError(w, errInternal("%v", err))
 			return
 		}
-		log.Println("API request created successfully:", request)
-
-		// 设置请求头
-		request.Header.Set("Authorization", "Bearer "+keys)
-		//fmt.Println("Authorization", "Bearer "+keys)
-		request.Header.Set("Content-Type", "application/json")
-		request.Header.Set("Accept", "*/*")
-		request.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
-		request.Header.Set("Cache-Control", "no-cache")
-		request.Header.Set("Origin", "https://novelai.net")
-		request.Header.Set("Pragma", "no-cache")
-		request.Header.Set("Referer", "https://novelai.net/")
-		log.Println("Request headers set.")
-		//fmt.Println("Authorization", r.Header.Get("Authorization"))
-
-		// 发送请求
-		resp, err = client.Do(request)
-		if err != nil {
-			log.Printf("(发送请求失败)Failed to send request: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := stream.Start(); err != nil {
+			log.Printf("Failed to start SSE stream: %v", err)
+			return
 		}
+		stopKeepAlive := stream.KeepAlive(sseKeepAliveInterval)
+		defer stopKeepAlive()
+	}
 
-		// 401 状态码指的是 API 密钥未经过身份验证
-		if resp.StatusCode == http.StatusUnauthorized {
-			log.Printf("API Key unauthorized (401): %s", resp.Status)
-			// 先释放 key 值
-			ReleaseKey(keys)
-			// 将 key 从文件中删除并添加到其他文件（假设你有一个函数来处理这个）
-			HandleUnauthorizedKey(keys) // 假设 HandleUnauthorizedKey 是你的处理函数
-			http.Error(w, "API Key unauthorized. Key potential expired or invalid.", http.StatusUnauthorized)
+	// fail 根据流是否已经开始选择错误的输出方式
+	fail := func(apiErr *APIError) {
+		log.Printf("画图失败: %v", apiErr)
+		if stream == nil {
+			writeError(w, apiErr)
 			return
 		}
-
-		log.Printf("Too many requests. Retrying in 5 seconds... code: %d", resp.StatusCode)
-
-		// 如果状态码不等于 200 则重试
-		if resp.StatusCode == http.StatusOK {
-			// 先释放 key 值
-			ReleaseKey(keys)
-			break
+		if err := stream.Error(apiErr); err != nil {
+			log.Printf("写入流式错误失败: %v", err)
 		}
-
-		// 先释放 key 值
-		ReleaseKey(keys)
-
-		// 等待 5 秒
-		time.Sleep(5 * time.Second)
 	}
 
-	// 如果最终状态码不等于 200 则返回
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("最终状态码为:%d", resp.StatusCode)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		// 释放key值
-		ReleaseKey(keys)
-		return
+	// 排队等待秘钥时按配置在流中推送排队位置
+	var onQueue func(position int)
+	if stream != nil && config.Clients.ReportQueuePosition {
+		onQueue = func(position int) {
+			if err := stream.QueuePosition(position); err != nil {
+				log.Printf("写入排队位置失败: %v", err)
+			}
+		}
 	}
 
-	//log.Printf("Received response with status code: %d", resp.StatusCode)
-
-	// 读取响应体
-	bodyBytes, err := io.ReadAll(resp.Body)
+	images, err := generateImages(r.Context(), config, &generateRequest{
+		Model:          model,
+		Prompt:         positiveWords + qualityTags,
+		NegativePrompt: negativeWords + negativeTags,
+		ReferenceImage: base64String,
+		ReferenceMode:  req.ReferenceMode,
+		Client:         session.Name,
+		OnQueue:        onQueue,
+	})
 	if err != nil {
-		http.Error(w, "Failed to read response body: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("Failed to read response body: %v", err)
+		fail(asAPIError(err))
 		return
 	}
-	log.Println("Response body read successfully.")
+	generated = 1
 
-	// 创建 ZIP 读取器
-	zipReader, err := zip.NewReader(bytes.NewReader(bodyBytes), int64(len(bodyBytes)))
+	// 只取第一张图片进行推送
+	outputs, imageName, err := uploadImage(config, images[0])
 	if err != nil {
-		http.Error(w, "Failed to read ZIP file: "+err.Error(), http.StatusInternalServerError)
-		log.Printf("Failed to create zip reader: %v", err)
+		fail(errInternal("Failed to upload image: %v", err))
 		return
 	}
-	log.Println("ZIP file read successfully.")
-
-	// 获取当前时间戳
-	timestamp := time.Now().Unix()
-	imageName := fmt.Sprintf("%d.png", timestamp)
-	imagePath := "./" + imageName
-	log.Printf("Image will be saved as: %s", imagePath)
-
-	// 提取指定的图像文件并进行流式输出
-	for _, file := range zipReader.File {
-		if file.Name == "image_0.png" { // 根据实际文件名进行匹配
-			dstFile, err := os.Create(fmt.Sprintf("./%s", imageName))
-			if err != nil {
-				http.Error(w, "创建图像文件失败: "+err.Error(), http.StatusInternalServerError)
-				log.Printf("创建图像文件失败: %v", err)
-			}
-			defer dstFile.Close()
-
-			// 打开 ZIP 中的文件
-			srcFile, err := file.Open()
-			if err != nil {
-				http.Error(w, "打开 ZIP 中的文件失败: "+err.Error(), http.StatusInternalServerError)
-				log.Printf("打开 ZIP 中的文件失败: %v", err)
-			}
-
-			// 将图像写入目标文件
-			if _, err := io.Copy(dstFile, srcFile); err != nil {
-				http.Error(w, "写入图像文件失败: "+err.Error(), http.StatusInternalServerError)
-				log.Printf("写入图像文件失败: %v", err)
-			}
-			log.Println("图像文件写入成功。")
-
-			var outputs string
-			// 判断推送类型
-			if channelName == "Alist" {
-				// 构建上传命令和参数
-				cmd := exec.Command("sh", "Alist.sh", "--username", alistUsername, "--password", alistPassword, imageName, alistDir)
-
-				// 执行命令并获取输出
-				output, err := cmd.CombinedOutput() // CombinedOutput captures both stdout and stderr
-				if err != nil {
-					log.Printf("命令执行失败: %s 错误: %s", output, err)
-				}
-
-				outputs = strings.ReplaceAll(string(output), "\n", "")
-			} else {
-				// 构建上传命令和参数
-				cmd := exec.Command("sh", "Minio.sh", minioAlias, minioUrl, minioAccessKey, minioSecretKey, imageName, minioBucket)
 
-				// 执行命令并获取输出
-				output, err := cmd.CombinedOutput() // CombinedOutput captures both stdout and stderr
-				if err != nil {
-					log.Printf("命令执行失败: %s 错误: %s", output, err)
-				}
+	publicLink := fmt.Sprintf("![%s](%s)", imageName, outputs)
 
-				outputs = strings.ReplaceAll(string(output), "\n", "")
-			}
-
-			// 打印命令输出
-			//log.Printf("URL输出:\n%s\n", output)
+	// 非流式请求直接返回完整的 chat.completion 对象
+	if stream == nil {
+		writeCompletion(w, req.Model, time.Now().Unix(), publicLink)
+		return
+	}
 
-			publicLink := fmt.Sprintf("![%s](%s)", imageName, outputs)
-			fmt.Println(publicLink)
+	if err := stream.Content(publicLink); err != nil {
+		log.Printf("写入流式输出失败: %v", err)
+		return
+	}
 
-			// 组装流式输出数据
-			sseResponse := fmt.Sprintf(
-				"data: {\"id\":\"%s\",\"object\":\"chat.completion.chunk\",\"created\":%d,\"model\":\"%s\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"%s\"},\"logprobs\":null,\"finish_reason\":null}]}\n\n",
-				"chatcmpl-"+fmt.Sprintf("%d", timestamp), // 生成一个唯一的 id
-				timestamp,
-				req.Model,
-				publicLink,
-			)
+	// 结束流式输出
+	if err := stream.Finish(); err != nil {
+		log.Printf("结束流式输出失败: %v", err)
+	}
+}
 
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Write([]byte(sseResponse))
-			w.(http.Flusher).Flush() // 刷新响应缓冲区到客户端
-			break
-		}
+// writeCompletion 以非流式格式返回一次完整的对话补全结果
+func writeCompletion(w http.ResponseWriter, model string, created int64, content string) {
+	finishReason := "stop"
+	resp := Response{
+		ID:      fmt.Sprintf("chatcmpl-%d", created),
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+		Choices: []Choice{
+			{
+				Message:      &Message{Role: "assistant", Content: content},
+				FinishReason: &finishReason,
+				Index:        0,
+			},
+		},
 	}
 
-	// 结束流式输出
-	w.Write([]byte("event: end\n\n"))
-	w.(http.Flusher).Flush() // 刷新最后一条消息
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
 }
 
 // 启用 CORS
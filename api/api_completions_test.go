@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeCompletion(rec, "nai-diffusion-3", 1700000000, "![a.png](https://example.com/a.png)")
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	// 按原始 JSON 检查字段，确认非流式响应不带 delta
+	var resp struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v", err)
+	}
+	if resp.ID != "chatcmpl-1700000000" || resp.Object != "chat.completion" || resp.Created != 1700000000 || resp.Model != "nai-diffusion-3" {
+		t.Errorf("unexpected header fields: %s", rec.Body.String())
+	}
+	if len(resp.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(resp.Choices))
+	}
+	choice := resp.Choices[0]
+	if _, ok := choice["delta"]; ok {
+		t.Errorf("non-stream choice has a delta: %s", rec.Body.String())
+	}
+	var message Message
+	if err := json.Unmarshal(choice["message"], &message); err != nil {
+		t.Fatalf("choice has no message: %s", rec.Body.String())
+	}
+	if message.Role != "assistant" || message.Content != "![a.png](https://example.com/a.png)" {
+		t.Errorf("message = %+v", message)
+	}
+	if got := string(choice["finish_reason"]); got != `"stop"` {
+		t.Errorf("finish_reason = %s, want \"stop\"", got)
+	}
+	if got := string(choice["index"]); got != "0" {
+		t.Errorf("index = %s, want 0", got)
+	}
+}
+
+// useUploadScript 切换到临时目录，并在其中放一个把图片名拼成链接输出的 Minio.sh
+// 测试结束后恢复工作目录
+func useUploadScript(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\n# 参数: alias url access_key secret_key 图片名 bucket\necho \"https://cdn.example.com/$6/$5\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "Minio.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+}
+
+func TestCompletionsNonStream(t *testing.T) {
+	var gotAuth, gotInput string
+	images := zipImages(t, []byte("\x89PNG fake"))
+	config := useFakeNovelAI(t, func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		var payload struct {
+			Input string `json:"input"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		gotInput = payload.Input
+		w.Write(images)
+	}, func(c *Config) {
+		c.Channel.Name = "Minio"
+		c.Minio.Bucket = "images"
+	}, "pst-key")
+	useUploadScript(t)
+
+	body := `{"model":"` + config.Models[0].ID + `","stream":false,"messages":[{"role":"user","content":"正词1girl，smile 反词lowres"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer sk-test")
+	rec := httptest.NewRecorder()
+	Completions(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if gotAuth != "Bearer pst-key" || !strings.HasPrefix(gotInput, "1girl, smile") {
+		t.Errorf("NovelAI got Authorization %q, input %q", gotAuth, gotInput)
+	}
+
+	var resp struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %s", rec.Body.String())
+	}
+	if resp.Object != "chat.completion" || resp.Model != config.Models[0].ID || !strings.HasPrefix(resp.ID, "chatcmpl-") || resp.Created == 0 {
+		t.Errorf("unexpected header fields: %s", rec.Body.String())
+	}
+	if len(resp.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(resp.Choices))
+	}
+	choice := resp.Choices[0]
+	if _, ok := choice["delta"]; ok {
+		t.Errorf("non-stream choice has a delta: %s", rec.Body.String())
+	}
+	var message Message
+	if err := json.Unmarshal(choice["message"], &message); err != nil {
+		t.Fatalf("choice has no message: %s", rec.Body.String())
+	}
+	// 内容是指向推送后图片的 Markdown 图片链接
+	link := regexp.MustCompile(`^!\[(\d+\.png)\]\(https://cdn\.example\.com/images/(\d+\.png)\)$`).FindStringSubmatch(message.Content)
+	if message.Role != "assistant" || link == nil || link[1] != link[2] {
+		t.Errorf("message = %+v", message)
+	}
+	if got := string(choice["finish_reason"]); got != `"stop"` {
+		t.Errorf("finish_reason = %s, want \"stop\"", got)
+	}
+
+	// 秘钥已释放，临时图片已清理
+	if _, idle := keyPool.Counts(); idle != 1 {
+		t.Errorf("key not released after the request")
+	}
+	if files, _ := filepath.Glob("*.png"); len(files) != 0 {
+		t.Errorf("temporary images left behind: %v", files)
+	}
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 定义配置文件结构体，启动时加载并校验一次，所有处理函数共享
+type Config struct {
+	Channel    ChannelConfig    `yaml:"channel"`
+	SK         SKConfig         `yaml:"sk"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Alist      AlistConfig      `yaml:"alist"`
+	Minio      MinioConfig      `yaml:"minio"`
+	NovelAI    NovelAIConfig    `yaml:"novelai"`
+	Nkey       NkeyConfig       `yaml:"Nkey"`
+	Accounts   AccountsConfig   `yaml:"accounts"`
+	Pool       PoolConfig       `yaml:"pool"`
+	Clients    ClientsConfig    `yaml:"clients"`
+	Server     ServerConfig     `yaml:"server"`
+	Models     []ModelConfig    `yaml:"models"`
+	Parameters ParametersConfig `yaml:"parameters"`
+}
+
+// ChannelConfig 推送程序选择
+type ChannelConfig struct {
+	Name string `yaml:"name"` // Alist 或 Minio
+}
+
+// SKConfig 自定义 OpenAI 格式的 key
+type SKConfig struct {
+	Key string `yaml:"key"`
+}
+
+// AdminConfig 管理接口配置
+type AdminConfig struct {
+	Secret string `yaml:"secret"` // 管理接口秘钥，必须与 sk.key 不同；为空时不开放管理接口；可通过 NOVEL_ADMIN_SECRET 覆盖
+}
+
+// AlistConfig Alist 推送配置
+type AlistConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Dir      string `yaml:"dir"`
+}
+
+// MinioConfig Minio 推送配置
+type MinioConfig struct {
+	AccessKey string `yaml:"AccessKey"`
+	SecretKey string `yaml:"SecretKey"`
+	Bucket    string `yaml:"Bucket"`
+	Alias     string `yaml:"Alias"`
+	Url       string `yaml:"Url"`
+}
+
+// NovelAIConfig NovelAI 接口地址与超时，地址可以指向本地的模拟服务用于测试
+type NovelAIConfig struct {
+	APIURL   string        `yaml:"api_url"`   // 账号、订阅等接口，默认 https://api.novelai.net
+	ImageURL string        `yaml:"image_url"` // 画图接口，默认 https://image.novelai.net
+	Timeout  time.Duration `yaml:"timeout"`   // 单次画图请求（含读取响应）的最长时间，超时返回 504，默认 2m
+}
+
+// NkeyConfig NovelAI 秘钥存储配置
+type NkeyConfig struct {
+	Store   string `yaml:"store"`    // 秘钥库文件，保存秘钥、元数据与每日用量
+	Path    string `yaml:"path"`     // 可用秘钥的纯文本文件，秘钥库第一次创建时导入，之后由秘钥池写出并监听外部修改
+	PathErr string `yaml:"path_err"` // 旧版失效秘钥文件，秘钥库第一次创建时导入
+}
+
+// AccountsConfig NovelAI 账号配置，账号登录得到的令牌会加入秘钥池并在过期前自动重新登录
+type AccountsConfig struct {
+	Secret        string        `yaml:"secret"`         // 加密保存账号密码用的口令，可通过 NOVEL_ACCOUNTS_SECRET 覆盖；为空时使用 key_file
+	KeyFile       string        `yaml:"key_file"`       // secret 为空时使用的加密密钥文件，不存在时自动生成
+	RefreshBefore time.Duration `yaml:"refresh_before"` // 令牌到期前多久重新登录
+}
+
+// PoolConfig NovelAI 秘钥池配置
+type PoolConfig struct {
+	AcquireTimeout time.Duration `yaml:"acquire_timeout"` // 所有秘钥都被占用时最长的排队等待时间
+	Strategy       string        `yaml:"strategy"`        // 秘钥选择策略: random、round_robin、lru、least_used_today、weighted
+	MaxConcurrency int           `yaml:"max_concurrency"` // 每个秘钥默认的最大并发请求数，可在秘钥文件中单独设置
+	Cooldown       time.Duration `yaml:"cooldown"`        // 秘钥被限流 (429) 且没有 Retry-After 时的初始冷却时间，连续限流时翻倍
+	MaxCooldown    time.Duration `yaml:"max_cooldown"`    // 冷却时间的上限
+
+	QuarantineAfter int           `yaml:"quarantine_after"` // 连续多少次 401 后隔离秘钥
+	ProbeInterval   time.Duration `yaml:"probe_interval"`   // 隔离秘钥的探测间隔
+	DisableAfter    int           `yaml:"disable_after"`    // 隔离后连续多少次探测仍为 401 时移入失效列表
+
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"` // 后台检查所有秘钥订阅状态的间隔，0 表示不检查
+	FreeOnly            string        `yaml:"free_only"`             // 会扣点的请求如何处理: off(允许)、reject(拒绝)、downgrade(降级为不扣点的参数)
+}
+
+// ClientsConfig 调用方 API key 注册表配置
+type ClientsConfig struct {
+	Path                string `yaml:"path"`                  // 注册表文件地址
+	RateLimitRPM        int    `yaml:"rate_limit_rpm"`        // 调用方默认的每分钟请求数限制，0 表示不限
+	ReportQueuePosition bool   `yaml:"report_queue_position"` // 流式请求排队等待秘钥时是否在 SSE 流中推送排队位置
+}
+
+// ServerConfig 服务监听配置，均可通过 NOVEL_SERVER_* 环境变量覆盖
+type ServerConfig struct {
+	Address      string        `yaml:"address"`       // 监听地址，为空时监听所有网卡
+	Port         string        `yaml:"port"`          // 监听端口
+	ReadTimeout  time.Duration `yaml:"read_timeout"`  // 读取请求的超时时间
+	WriteTimeout time.Duration `yaml:"write_timeout"` // 写出响应的超时时间，0 表示不限制（画图与流式输出可能较久）
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`  // keep-alive 连接的空闲超时时间
+	TLSCert      string        `yaml:"tls_cert"`      // TLS 证书文件，与 tls_key 同时配置时启用 HTTPS
+	TLSKey       string        `yaml:"tls_key"`       // TLS 私钥文件
+	AdminAddress string        `yaml:"admin_address"` // 管理接口(/tokens*、/accounts*、/clients、/web/)单独监听的地址，例如 127.0.0.1:3389；为空时与 API 共用端口
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // 关闭时等待进行中的画图任务完成的最长时间
+}
+
+// Addr 返回 API 服务的监听地址
+func (s ServerConfig) Addr() string {
+	return net.JoinHostPort(s.Address, s.Port)
+}
+
+// TLSEnabled 返回是否启用了 HTTPS
+func (s ServerConfig) TLSEnabled() bool {
+	return s.TLSCert != "" && s.TLSKey != ""
+}
+
+// serverEnvVars 列出可以覆盖 server 配置的环境变量
+var serverEnvVars = []struct {
+	name  string
+	apply func(s *ServerConfig, value string) error
+}{
+	{"NOVEL_SERVER_ADDRESS", func(s *ServerConfig, v string) error { s.Address = v; return nil }},
+	{"NOVEL_SERVER_PORT", func(s *ServerConfig, v string) error { s.Port = v; return nil }},
+	{"NOVEL_SERVER_READ_TIMEOUT", func(s *ServerConfig, v string) error { return parseDurationEnv(&s.ReadTimeout, v) }},
+	{"NOVEL_SERVER_WRITE_TIMEOUT", func(s *ServerConfig, v string) error { return parseDurationEnv(&s.WriteTimeout, v) }},
+	{"NOVEL_SERVER_IDLE_TIMEOUT", func(s *ServerConfig, v string) error { return parseDurationEnv(&s.IdleTimeout, v) }},
+	{"NOVEL_SERVER_TLS_CERT", func(s *ServerConfig, v string) error { s.TLSCert = v; return nil }},
+	{"NOVEL_SERVER_TLS_KEY", func(s *ServerConfig, v string) error { s.TLSKey = v; return nil }},
+	{"NOVEL_SERVER_ADMIN_ADDRESS", func(s *ServerConfig, v string) error { s.AdminAddress = v; return nil }},
+	{"NOVEL_SERVER_SHUTDOWN_TIMEOUT", func(s *ServerConfig, v string) error { return parseDurationEnv(&s.ShutdownTimeout, v) }},
+}
+
+// parseDurationEnv 解析形如 "30s" 的时长
+func parseDurationEnv(target *time.Duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*target = d
+	return nil
+}
+
+// ParametersConfig NovelAI 画图参数
+type ParametersConfig struct {
+	ParamsVersion               int         `yaml:"params_version"`
+	Width                       int         `yaml:"width"`
+	Height                      int         `yaml:"height"`
+	Scale                       float64     `yaml:"scale"`
+	Sampler                     string      `yaml:"sampler"`
+	Steps                       int         `yaml:"steps"`
+	NSamples                    int         `yaml:"n_samples"`
+	UCPreset                    int         `yaml:"ucPreset"`
+	QualityToggle               bool        `yaml:"qualityToggle"`
+	SM                          bool        `yaml:"sm"`
+	SMDyn                       bool        `yaml:"sm_dyn"`
+	DynamicThresholding         bool        `yaml:"dynamic_thresholding"`
+	ControlNetStrength          float64     `yaml:"controlnet_strength"`
+	Legacy                      bool        `yaml:"legacy"`
+	AddOriginalImage            bool        `yaml:"add_original_image"`
+	CFGRescale                  float64     `yaml:"cfg_rescale"`
+	NoiseSchedule               string      `yaml:"noise_schedule"`
+	LegacyV3Extend              bool        `yaml:"legacy_v3_extend"`
+	SkipCFGAboveSigma           interface{} `yaml:"skip_cfg_above_sigma"`
+	DeliberateEulerAncestralBug bool        `yaml:"deliberate_euler_ancestral_bug"`
+	PreferBrownian              bool        `yaml:"prefer_brownian"`
+}
+
+// currentConfig 保存当前生效的配置
+var currentConfig atomic.Pointer[Config]
+
+// GetConfig 返回当前生效的配置，调用方不应修改返回值
+func GetConfig() *Config {
+	return currentConfig.Load()
+}
+
+// SetConfig 设置当前生效的配置
+func SetConfig(config *Config) {
+	currentConfig.Store(config)
+}
+
+// LoadConfig 读取、解析并校验配置文件
+// 未知字段、类型错误以及缺失的必填项都会返回错误
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %w", path, err)
+	}
+
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment variable: %w", err)
+	}
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// applyEnv 使用环境变量覆盖配置文件中的值
+func (c *Config) applyEnv() error {
+	for _, env := range serverEnvVars {
+		value, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+		if err := env.apply(&c.Server, value); err != nil {
+			return fmt.Errorf("%s: %w", env.name, err)
+		}
+	}
+	if value, ok := os.LookupEnv("NOVEL_ADMIN_SECRET"); ok {
+		c.Admin.Secret = value
+	}
+	if value, ok := os.LookupEnv("NOVEL_ACCOUNTS_SECRET"); ok {
+		c.Accounts.Secret = value
+	}
+	return nil
+}
+
+// applyDefaults 为可选配置项填充默认值
+func (c *Config) applyDefaults() {
+	// 未配置模型目录时使用内置的默认模型
+	if len(c.Models) == 0 {
+		c.Models = defaultModels
+	}
+	if c.NovelAI.APIURL == "" {
+		c.NovelAI.APIURL = "https://api.novelai.net"
+	}
+	if c.NovelAI.ImageURL == "" {
+		c.NovelAI.ImageURL = "https://image.novelai.net"
+	}
+	c.NovelAI.APIURL = strings.TrimRight(c.NovelAI.APIURL, "/")
+	c.NovelAI.ImageURL = strings.TrimRight(c.NovelAI.ImageURL, "/")
+	if c.NovelAI.Timeout == 0 {
+		c.NovelAI.Timeout = 2 * time.Minute
+	}
+	if c.Pool.FreeOnly == "" {
+		c.Pool.FreeOnly = freeOnlyOff
+	}
+	if c.Pool.AcquireTimeout == 0 {
+		c.Pool.AcquireTimeout = 120 * time.Second
+	}
+	if c.Pool.Strategy == "" {
+		c.Pool.Strategy = strategyRandom
+	}
+	if c.Pool.MaxConcurrency == 0 {
+		c.Pool.MaxConcurrency = 1
+	}
+	if c.Pool.Cooldown == 0 {
+		c.Pool.Cooldown = 10 * time.Second
+	}
+	if c.Pool.MaxCooldown == 0 {
+		c.Pool.MaxCooldown = 5 * time.Minute
+	}
+	if c.Pool.QuarantineAfter == 0 {
+		c.Pool.QuarantineAfter = 3
+	}
+	if c.Pool.ProbeInterval == 0 {
+		c.Pool.ProbeInterval = 10 * time.Minute
+	}
+	if c.Pool.DisableAfter == 0 {
+		c.Pool.DisableAfter = 6
+	}
+	if c.Nkey.Store == "" {
+		c.Nkey.Store = "keys/tokens.db"
+	}
+	if c.Accounts.KeyFile == "" {
+		c.Accounts.KeyFile = "keys/accounts.key"
+	}
+	if c.Accounts.RefreshBefore == 0 {
+		c.Accounts.RefreshBefore = time.Hour
+	}
+	if c.Clients.Path == "" {
+		c.Clients.Path = "keys/clients.json"
+	}
+	if c.Server.Port == "" {
+		c.Server.Port = "3388"
+	}
+	if c.Server.ReadTimeout == 0 {
+		c.Server.ReadTimeout = 60 * time.Second
+	}
+	if c.Server.IdleTimeout == 0 {
+		c.Server.IdleTimeout = 120 * time.Second
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 60 * time.Second
+	}
+}
+
+// validate 检查必填项与取值范围，一次性返回所有问题
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.SK.Key != "", "sk.key is required")
+	check(c.Admin.Secret == "" || c.Admin.Secret != c.SK.Key, "admin.secret must differ from sk.key")
+
+	switch c.Channel.Name {
+	case "Alist":
+		check(c.Alist.Dir != "", "alist.dir is required when channel.name is Alist")
+	case "Minio":
+		check(c.Minio.Url != "", "minio.Url is required when channel.name is Minio")
+		check(c.Minio.Bucket != "", "minio.Bucket is required when channel.name is Minio")
+		check(c.Minio.Alias != "", "minio.Alias is required when channel.name is Minio")
+	default:
+		errs = append(errs, fmt.Errorf("channel.name must be Alist or Minio, got %q", c.Channel.Name))
+	}
+
+	check(c.Nkey.Path != "", "Nkey.path is required")
+	check(c.Nkey.PathErr != "", "Nkey.path_err is required")
+	for _, endpoint := range []struct{ name, value string }{
+		{"novelai.api_url", c.NovelAI.APIURL},
+		{"novelai.image_url", c.NovelAI.ImageURL},
+	} {
+		u, err := url.Parse(endpoint.value)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "%s must be an http(s) URL, got %q", endpoint.name, endpoint.value)
+	}
+	check(c.NovelAI.Timeout > 0, "novelai.timeout must be positive")
+	check(c.Accounts.RefreshBefore > 0, "accounts.refresh_before must be positive")
+	check(c.Pool.HealthCheckInterval >= 0, "pool.health_check_interval must not be negative")
+	check(slices.Contains(freeOnlyModes, c.Pool.FreeOnly), "pool.free_only must be one of %s, got %q", strings.Join(freeOnlyModes, ", "), c.Pool.FreeOnly)
+	check(c.Pool.AcquireTimeout > 0, "pool.acquire_timeout must be positive")
+	check(slices.Contains(keyStrategies, c.Pool.Strategy), "pool.strategy must be one of %s, got %q", strings.Join(keyStrategies, ", "), c.Pool.Strategy)
+	check(c.Pool.MaxConcurrency > 0, "pool.max_concurrency must be positive")
+	check(c.Pool.Cooldown > 0, "pool.cooldown must be positive")
+	check(c.Pool.MaxCooldown >= c.Pool.Cooldown, "pool.max_cooldown must not be less than pool.cooldown")
+	check(c.Pool.QuarantineAfter > 0, "pool.quarantine_after must be positive")
+	check(c.Pool.ProbeInterval > 0, "pool.probe_interval must be positive")
+	check(c.Pool.DisableAfter > 0, "pool.disable_after must be positive")
+	check(c.Clients.RateLimitRPM >= 0, "clients.rate_limit_rpm must not be negative")
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port must be a valid port number, got %q", c.Server.Port)
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout must not be negative")
+	check(c.Server.ShutdownTimeout >= 0, "server.shutdown_timeout must not be negative")
+	check((c.Server.TLSCert == "") == (c.Server.TLSKey == ""), "server.tls_cert and server.tls_key must be set together")
+	if c.Server.AdminAddress != "" {
+		_, _, err := net.SplitHostPort(c.Server.AdminAddress)
+		check(err == nil, "server.admin_address must be host:port, got %q", c.Server.AdminAddress)
+		check(c.Server.AdminAddress != c.Server.Addr(), "server.admin_address must differ from the API address")
+	}
+
+	ids := make(map[string]bool)
+	for i, model := range c.Models {
+		check(model.ID != "", "models[%d].id is required", i)
+		check(model.Model != "", "models[%d].model is required", i)
+		check(!ids[model.ID], "models[%d].id %q is duplicated", i, model.ID)
+		ids[model.ID] = true
+	}
+
+	p := c.Parameters
+	check(p.Width > 0 && p.Width%64 == 0, "parameters.width must be a positive multiple of 64, got %d", p.Width)
+	check(p.Height > 0 && p.Height%64 == 0, "parameters.height must be a positive multiple of 64, got %d", p.Height)
+	check(p.Scale > 0 && p.Scale <= 10, "parameters.scale must be in (0, 10], got %v", p.Scale)
+	check(p.Steps >= 1 && p.Steps <= 50, "parameters.steps must be in [1, 50], got %d", p.Steps)
+	check(p.NSamples >= 1, "parameters.n_samples must be at least 1, got %d", p.NSamples)
+	check(p.CFGRescale >= 0 && p.CFGRescale <= 1, "parameters.cfg_rescale must be in [0, 1], got %v", p.CFGRescale)
+	check(strings.TrimSpace(p.Sampler) != "", "parameters.sampler is required")
+	check(strings.TrimSpace(p.NoiseSchedule) != "", "parameters.noise_schedule is required")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestConfig 设置一份填充了默认值的配置，测试结束后恢复原来的配置
+func useTestConfig(t *testing.T, modify func(c *Config)) *Config {
+	t.Helper()
+	c := &Config{SK: SKConfig{Key: "sk-test"}}
+	c.applyDefaults()
+	if modify != nil {
+		modify(c)
+	}
+	old := GetConfig()
+	SetConfig(c)
+	t.Cleanup(func() { SetConfig(old) })
+	return c
+}
+
+func TestLoadConfig(t *testing.T) {
+	// 仓库自带的示例配置必须能通过校验
+	config, err := LoadConfig(filepath.Join("..", "config.yml"))
+	if err != nil {
+		t.Fatalf("LoadConfig(config.yml) = %v", err)
+	}
+	if config.Server.Port == "" || len(config.Models) == 0 {
+		t.Errorf("defaults not applied: port %q, %d models", config.Server.Port, len(config.Models))
+	}
+
+	example, err := os.ReadFile(filepath.Join("..", "config.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		edit    func(s string) string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			edit:    func(s string) string { return s + "\nunknown_field: 1\n" },
+			wantErr: "field unknown_field not found",
+		},
+		{
+			name:    "missing sk.key",
+			edit:    func(s string) string { return strings.Replace(s, `key: "sk-1a8a"`, `key: ""`, 1) },
+			wantErr: "sk.key is required",
+		},
+		{
+			name:    "wrong type",
+			edit:    func(s string) string { return strings.Replace(s, "steps: 28", "steps: many", 1) },
+			wantErr: "cannot unmarshal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte(tt.edit(string(example))), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// configReloadDelay 用于合并编辑器保存时产生的多次写事件
+const configReloadDelay = 300 * time.Millisecond
+
+// sensitiveConfigKeys 中的配置项在差异日志里会被隐藏
+var sensitiveConfigKeys = map[string]bool{
+	"sk.key":          true,
+	"admin.secret":    true,
+	"alist.password":  true,
+	"minio.SecretKey": true,
+	"minio.AccessKey": true,
+	"accounts.secret": true,
+}
+
+// restartRequiredPrefixes 中的配置项修改后需要重启才能生效
+var restartRequiredPrefixes = []string{"server.", "Nkey.", "clients.path", "accounts.secret", "accounts.key_file"}
+
+// WatchConfig 监听配置文件的变化，新配置校验通过后原子替换当前配置
+// 校验失败时保留当前配置；已经开始的请求继续使用它们开始时取到的配置
+// 返回的函数用于停止监听
+func WatchConfig(path string) (stop func(), err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config watcher: %w", err)
+	}
+
+	// 监听所在目录而不是文件本身，编辑器"写临时文件再重命名"的保存方式也能被捕获
+	target := filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch config directory: %w", err)
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(configReloadDelay, func() { reloadConfig(path) })
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Config watcher error: %v", err)
+			}
+		}
+	}()
+
+	return func() { watcher.Close() }, nil
+}
+
+// reloadConfig 重新加载配置文件并在校验通过后替换当前配置
+func reloadConfig(path string) {
+	newConfig, err := LoadConfig(path)
+	if err != nil {
+		log.Printf("配置文件重新加载失败，继续使用当前配置: %v", err)
+		return
+	}
+
+	changes := diffConfig(GetConfig(), newConfig)
+	if len(changes) == 0 {
+		return
+	}
+
+	SetConfig(newConfig)
+	log.Printf("配置文件已重新加载，共 %d 处变更:", len(changes))
+	for _, change := range changes {
+		log.Printf("  %s", change)
+	}
+}
+
+// diffConfig 返回两份配置之间的差异描述，按配置项排序
+func diffConfig(oldConfig, newConfig *Config) []string {
+	oldValues := flattenConfig(oldConfig)
+	newValues := flattenConfig(newConfig)
+
+	keys := make(map[string]bool)
+	for key := range oldValues {
+		keys[key] = true
+	}
+	for key := range newValues {
+		keys[key] = true
+	}
+
+	var changes []string
+	for key := range keys {
+		oldValue, hadOld := oldValues[key]
+		newValue, hasNew := newValues[key]
+		if hadOld && hasNew && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		describe := func(value interface{}, ok bool) string {
+			if !ok {
+				return "<unset>"
+			}
+			if sensitiveConfigKeys[key] {
+				return "******"
+			}
+			return fmt.Sprintf("%v", value)
+		}
+		change := fmt.Sprintf("%s: %s -> %s", key, describe(oldValue, hadOld), describe(newValue, hasNew))
+		for _, prefix := range restartRequiredPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				change += " (需要重启才能生效)"
+				break
+			}
+		}
+		changes = append(changes, change)
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// flattenConfig 将配置展开为 "a.b.c" => 值 的形式，便于比较
+func flattenConfig(config *Config) map[string]interface{} {
+	values := make(map[string]interface{})
+	if config == nil {
+		return values
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return values
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return values
+	}
+
+	var walk func(prefix string, node interface{})
+	walk = func(prefix string, node interface{}) {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				walk(key, child)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), child)
+			}
+		default:
+			values[prefix] = v
+		}
+	}
+	walk("", tree)
+	return values
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "no changes",
+			modify: func(c *Config) {},
+			want:   nil,
+		},
+		{
+			name:   "prefix match does not cover sibling keys",
+			modify: func(c *Config) { c.Clients.RateLimitRPM = 60 },
+			want:   []string{"clients.rate_limit_rpm: 0 -> 60"},
+		},
+		{
+			name:   "hot reloadable value",
+			modify: func(c *Config) { c.Parameters.Steps = 28 },
+			want:   []string{"parameters.steps: 0 -> 28"},
+		},
+		{
+			name:   "hot reloadable duration",
+			modify: func(c *Config) { c.Pool.Cooldown = 20 * time.Second },
+			want:   []string{"pool.cooldown: 10s -> 20s"},
+		},
+		{
+			name:   "restart required",
+			modify: func(c *Config) { c.Server.Port = "4000" },
+			want:   []string{"server.port: 3388 -> 4000 (需要重启才能生效)"},
+		},
+		{
+			name:   "sensitive value is masked",
+			modify: func(c *Config) { c.SK.Key = "sk-new" },
+			want:   []string{"sk.key: ****** -> ******"},
+		},
+		{
+			name:   "sensitive and restart required",
+			modify: func(c *Config) { c.Accounts.Secret = "passphrase" },
+			want:   []string{"accounts.secret: ****** -> ****** (需要重启才能生效)"},
+		},
+		{
+			name: "list element and sorting",
+			modify: func(c *Config) {
+				c.Nkey.Path = "keys/other"
+				c.Models = append(slices.Clone(c.Models), ModelConfig{ID: "extra", Model: "nai-diffusion-3"})
+			},
+			want: []string{
+				"Nkey.path: keys/tokens -> keys/other (需要重启才能生效)",
+				"models[2].id: <unset> -> extra",
+				"models[2].img2img: <unset> -> false",
+				"models[2].model: <unset> -> nai-diffusion-3",
+				"models[2].vibe_transfer: <unset> -> false",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldConfig := &Config{SK: SKConfig{Key: "sk-test"}, Nkey: NkeyConfig{Path: "keys/tokens"}}
+			oldConfig.applyDefaults()
+			newConfig := *oldConfig
+			tt.modify(&newConfig)
+
+			got := diffConfig(oldConfig, &newConfig)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("diffConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError 是所有 OpenAI 兼容接口统一使用的错误类型
+// 序列化后为 {"error":{"message","type","code","param"}}
+type APIError struct {
+	Status  int     `json:"-"`
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    string  `json:"code"`
+	Param   *string `json:"param"`
+
+	RetryAfter time.Duration `json:"-"` // 大于 0 时通过 Retry-After 响应头告知客户端何时重试
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// newAPIError 创建一个 APIError，param 为空字符串时序列化为 null
+func newAPIError(status int, errType, code, param, message string) *APIError {
+	e := &APIError{Status: status, Message: message, Type: errType, Code: code}
+	if param != "" {
+		e.Param = &param
+	}
+	return e
+}
+
+// errInvalidAPIKey 对应 sk key 校验失败 (401)
+func errInvalidAPIKey() *APIError {
+	return newAPIError(http.StatusUnauthorized, "invalid_request_error", "invalid_api_key", "", "Authentication failed. Unauthorized.")
+}
+
+// errBadRequest 对应请求体或参数错误 (400)
+func errBadRequest(param, format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusBadRequest, "invalid_request_error", "invalid_request", param, fmt.Sprintf(format, args...))
+}
+
+// errModelNotFound 对应未知模型 (404)
+func errModelNotFound(model string) *APIError {
+	return newAPIError(http.StatusNotFound, "invalid_request_error", "model_not_found", "model", fmt.Sprintf("The model `%s` does not exist", model))
+}
+
+// errMethodNotAllowed 对应请求方法错误 (405)
+func errMethodNotAllowed(method string) *APIError {
+	return newAPIError(http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "", fmt.Sprintf("Method %s not allowed", method))
+}
+
+// errPoolExhausted 对应秘钥池没有可用秘钥 (429)
+func errPoolExhausted(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusTooManyRequests, "rate_limit_error", "pool_exhausted", "", fmt.Sprintf(format, args...))
+}
+
+// errNoKeys 对应秘钥池中没有配置任何秘钥 (503)
+func errNoKeys() *APIError {
+	return newAPIError(http.StatusServiceUnavailable, "server_error", "no_keys_configured", "", "No NovelAI keys are configured on this server.")
+}
+
+// errInsufficientAnlas 对应所有可用秘钥的点数都不足以完成本次请求 (503)
+func errInsufficientAnlas(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusServiceUnavailable, "server_error", "insufficient_anlas", "", fmt.Sprintf(format, args...))
+}
+
+// errKeysQuarantined 对应所有秘钥都因为 401 被隔离 (503)
+func errKeysQuarantined() *APIError {
+	return newAPIError(http.StatusServiceUnavailable, "server_error", "no_keys_available", "", "All NovelAI keys are currently quarantined after authentication failures.")
+}
+
+// errUpstream 对应 NovelAI 返回错误 (502)
+func errUpstream(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusBadGateway, "upstream_error", "upstream_error", "", fmt.Sprintf(format, args...))
+}
+
+// errUpstreamTimeout 对应 NovelAI 超时 (504)
+func errUpstreamTimeout(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusGatewayTimeout, "upstream_error", "upstream_timeout", "", fmt.Sprintf(format, args...))
+}
+
+// errCancelled 对应请求被取消，例如客户端断开或服务正在关闭 (503)
+func errCancelled(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusServiceUnavailable, "server_error", "request_cancelled", "", fmt.Sprintf(format, args...))
+}
+
+// errInternal 对应服务内部错误 (500)
+func errInternal(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusInternalServerError, "server_error", "internal_error", "", fmt.Sprintf(format, args...))
+}
+
+// asAPIError 将任意错误转换为 APIError，非 APIError 视为内部错误
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return errInternal("%v", err)
+}
+
+// writeError 以 OpenAI 的格式返回错误，只能在写入响应头之前调用
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := asAPIError(err)
+	w.Header().Set("Content-Type", "application/json")
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(apiErr.Status)
+	if err := json.NewEncoder(w).Encode(map[string]*APIError{"error": apiErr}); err != nil {
+		log.Printf("写入错误响应失败: %v", err)
+	}
+}
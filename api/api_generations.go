@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 单次请求允许生成的最大图片数量
+const maxImagesPerRequest = 4
+
+// ImageRequest 定义 OpenAI Images API 的请求结构体
+type ImageRequest struct {
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+	Model          string `json:"model"`
+	NegativePrompt string `json:"negative_prompt"` // 扩展字段：反词
+}
+
+// ImageData 定义单张图片的返回内容
+type ImageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt"`
+}
+
+// ImageResponse 定义 OpenAI Images API 的响应结构体
+type ImageResponse struct {
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+// parseSize 解析形如 "832x1216" 的尺寸，NovelAI 要求宽高为 64 的倍数
+func parseSize(size string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(size), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT", size)
+	}
+	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid width in size %q", size)
+	}
+	height, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid height in size %q", size)
+	}
+	if width <= 0 || height <= 0 || width%64 != 0 || height%64 != 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, width and height must be positive multiples of 64", size)
+	}
+	return width, height, nil
+}
+
+// ImagesGenerations 处理 /v1/images/generations 请求
+func ImagesGenerations(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	// 如果是 OPTIONS 请求，直接返回 200 OK
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	config := GetConfig()
+
+	session, apiErr := authenticateClient(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	// 按调用方的每分钟请求数限流
+	if apiErr := session.checkRateLimit(config); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	// 解析请求体
+	var req ImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Failed to decode request body: %v", err)
+		writeError(w, errBadRequest("", "Invalid request body: %v", err))
+		return
+	}
+
+	if strings.TrimSpace(req.Prompt) == "" {
+		writeError(w, errBadRequest("prompt", "prompt is required"))
+		return
+	}
+	if req.N == 0 {
+		req.N = 1
+	}
+	if req.N < 0 || req.N > maxImagesPerRequest {
+		writeError(w, errBadRequest("n", "n must be between 1 and %d", maxImagesPerRequest))
+		return
+	}
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "url"
+	}
+	if req.ResponseFormat != "url" && req.ResponseFormat != "b64_json" {
+		writeError(w, errBadRequest("response_format", "response_format must be url or b64_json"))
+		return
+	}
+	// 未指定模型时使用模型目录中的第一个
+	if req.Model == "" {
+		req.Model = config.Models[0].ID
+	}
+	model := findModel(config, req.Model)
+	if model == nil {
+		writeError(w, errModelNotFound(req.Model))
+		return
+	}
+	if apiErr := session.checkModel(model.ID); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	if req.NegativePrompt == "" {
+		req.NegativePrompt = defaultNegativeWords
+	}
+
+	var width, height int
+	if req.Size != "" {
+		var err error
+		width, height, err = parseSize(req.Size)
+		if err != nil {
+			writeError(w, errBadRequest("size", "%v", err))
+			return
+		}
+	}
+
+	// 检查调用方的并发与额度，按生成的图片张数计
+	release, apiErr := session.reserve(req.N)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+	generated := 0
+	defer func() { release(generated) }()
+
+	// 记录进行中的任务，服务关闭时会等待其推送完成
+	defer beginGeneration()()
+
+	prompt := req.Prompt + qualityTags
+	images, err := generateImages(r.Context(), config, &generateRequest{
+		Model:          model,
+		Prompt:         prompt,
+		NegativePrompt: req.NegativePrompt,
+		Width:          width,
+		Height:         height,
+		NSamples:       req.N,
+		Client:         session.Name,
+	})
+	if err != nil {
+		log.Printf("画图失败: %v", err)
+		writeError(w, err)
+		return
+	}
+	generated = len(images)
+
+	resp := ImageResponse{Created: time.Now().Unix()}
+	for _, image := range images {
+		data := ImageData{RevisedPrompt: prompt}
+		if req.ResponseFormat == "b64_json" {
+			data.B64JSON = base64.StdEncoding.EncodeToString(image)
+		} else {
+			data.URL, _, err = uploadImage(config, image)
+			if err != nil {
+				log.Printf("上传图片失败: %v", err)
+				writeError(w, errInternal("Failed to upload image"))
+				return
+			}
+		}
+		resp.Data = append(resp.Data, data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
+}
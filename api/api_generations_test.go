@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size          string
+		width, height int
+		wantErr       bool
+	}{
+		{size: "832x1216", width: 832, height: 1216},
+		{size: "1024X1024", width: 1024, height: 1024},
+		{size: " 512 x 768 ", width: 512, height: 768},
+		{size: "1024", wantErr: true},
+		{size: "1024x1024x2", wantErr: true},
+		{size: "axb", wantErr: true},
+		{size: "1024x", wantErr: true},
+		{size: "0x1024", wantErr: true},
+		{size: "-64x64", wantErr: true},
+		{size: "1000x1024", wantErr: true},
+		{size: "1024x1000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			width, height, err := parseSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize(%q) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("parseSize(%q) = %dx%d, want %dx%d", tt.size, width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestImagesGenerationsRejectsInvalidRequests(t *testing.T) {
+	config := useTestConfig(t, nil)
+
+	tests := []struct {
+		name      string
+		body      string
+		wantParam string
+	}{
+		{name: "too many images", body: `{"prompt":"1girl","n":5}`, wantParam: "n"},
+		{name: "negative n", body: `{"prompt":"1girl","n":-1}`, wantParam: "n"},
+		{name: "missing prompt", body: `{"prompt":"  "}`, wantParam: "prompt"},
+		{name: "invalid size", body: `{"prompt":"1girl","size":"1000x1000"}`, wantParam: "size"},
+		{name: "invalid response format", body: `{"prompt":"1girl","response_format":"png"}`, wantParam: "response_format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+config.SK.Key)
+			rec := httptest.NewRecorder()
+			ImagesGenerations(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body.String())
+			}
+			var resp struct {
+				Error *APIError `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error == nil {
+				t.Fatalf("response is not an OpenAI error: %s", rec.Body.String())
+			}
+			if resp.Error.Param == nil || *resp.Error.Param != tt.wantParam {
+				t.Errorf("error param = %v, want %q", resp.Error.Param, tt.wantParam)
+			}
+		})
+	}
+}
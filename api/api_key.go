@@ -2,224 +2,580 @@ package api
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/spf13/viper"
-	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 )
 
-// 假设你有一个全局的 mutex 来保护对 token 文件的读写，以防止并发问题
-var tokenFileMutex sync.Mutex
+// ErrNoKeys 表示秘钥池中没有任何秘钥，此时不再等待
+var ErrNoKeys = errors.New("no keys configured")
 
-// keyStatusKey 是存储 key 状态的 map 的键类型
-type keyStatusKey string
+// ErrKeysQuarantined 表示所有秘钥都已被隔离，等待也不会有秘钥可用
+var ErrKeysQuarantined = errors.New("all keys are quarantined")
 
-// keyStatusValue 是存储 key 状态的 map 的值类型
-type keyStatusValue bool
+// ErrInsufficientAnlas 表示没有任何秘钥记录的剩余点数足够完成本次请求
+var ErrInsufficientAnlas = errors.New("no key has enough Anlas")
 
-// keyStatusMap 用于存储 key 的使用状态
-var keyStatusMap = make(map[keyStatusKey]keyStatusValue)
-
-// keyStatusMutex 用于保护 keyStatusMap 的并发访问
-var keyStatusMutex sync.Mutex
-
-// keyStatusCond 是条件变量，用于在 key 状态变化时通知等待者
-var keyStatusCond = sync.NewCond(&keyStatusMutex)
+// ErrAcquireTimeout 表示在超时时间内没有等到可用秘钥
+var ErrAcquireTimeout = errors.New("timed out waiting for an available key")
 
 // 为了演示，我们将随机数种子初始化放在 init 函数中
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-// GetAllKeysFromFile 读取文件中的所有有效秘钥
-// 注意: 这个函数假设 key 文件在程序运行时不会变化。
-// 如果文件会变化，需要更复杂的机制来重新加载和同步 key 列表。
-func getAllKeysFromFile(keyFilePath string) ([]string, error) {
-	file, err := os.Open(keyFilePath)
+// KeyPool 在内存中保存所有 NovelAI 秘钥及其使用状态
+// 它是秘钥库 (Nkey.store) 唯一的读写者：启动时加载一次，之后每次修改都先写入秘钥库再更新内存
+// 可用秘钥同时写出到纯文本文件 (Nkey.path)，外部修改该文件后由 WatchKeyFile 重新加载
+// 每个秘钥可以同时服务多个请求，上限由秘钥自身的 concurrency 或 pool.max_concurrency 决定
+type KeyPool struct {
+	mu          sync.Mutex
+	cond        *sync.Cond            // 秘钥释放、秘钥列表或等待队列变化时广播
+	store       *keyStore             // 秘钥库，为 nil 时只保存在内存中
+	file        string                // 可用秘钥的纯文本文件，为空时不写出
+	keys        []*poolKey            // 可用秘钥，保持加入的顺序
+	disabled    []*poolKey            // 失效秘钥
+	inUse       map[string]int        // token => 正在进行的请求数
+	usage       map[string]*keyUsage  // token => 使用情况
+	status      map[string]*keyStatus // token => 健康状态，不存在表示正常
+	transitions []KeyTransition       // 最近的状态变化记录
+	info        map[string]*KeyInfo   // token => 健康检查记录的订阅信息
+	cursor      int                   // round_robin 策略上一次选中的秘钥下标
+	queue       *fairQueue            // 等待秘钥的请求
+}
+
+// keyPool 是全局的秘钥池，由 InitKeyPool 初始化
+var keyPool = newKeyPool(nil)
+
+// newKeyPool 创建一个空的秘钥池
+func newKeyPool(store *keyStore) *KeyPool {
+	p := &KeyPool{
+		store:  store,
+		inUse:  make(map[string]int),
+		usage:  make(map[string]*keyUsage),
+		status: make(map[string]*keyStatus),
+		info:   make(map[string]*KeyInfo),
+		cursor: -1,
+		queue:  newFairQueue(),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// InitKeyPool 打开秘钥库并加载秘钥池
+// 秘钥库第一次创建时自动导入旧版的 Nkey.path 与 Nkey.path_err 秘钥文件
+func InitKeyPool(cfg NkeyConfig) error {
+	store, err := openKeyStore(cfg.Store)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("key file not found at: %s", keyFilePath)
-		}
-		return nil, fmt.Errorf("failed to open key file: %w", err)
+		return err
+	}
+	if _, err := store.importFiles(cfg.Path, cfg.PathErr); err != nil {
+		store.Close()
+		return err
+	}
+	active, disabled, err := store.load()
+	if err != nil {
+		store.Close()
+		return err
 	}
-	defer file.Close()
 
-	var keys []string
-	reader := bufio.NewReader(file)
-	for {
-		// ReadLine 读取一行，忽略换行符
-		// 注意: ReadLine 可能会返回切片，直到下一次调用前都有效。
-		// 对于长期存储或修改，应将 bytes 复制为 string。
-		// 这里因为是逐行处理，且只用于比较和添加到切片，直接使用 string 转换是安全的。
-		lineBytes, _, err := reader.ReadLine()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, fmt.Errorf("failed to read key file line: %w", err)
+	p := newKeyPool(store)
+	p.file = cfg.Path
+	today := time.Now().Format("2006-01-02")
+	for _, rec := range active {
+		p.keys = append(p.keys, rec.poolKey())
+		if rec.Info != nil {
+			p.info[rec.Token] = rec.Info
 		}
-		key := strings.TrimSpace(string(lineBytes))
-		if key != "" {
-			keys = append(keys, key)
+		// 恢复 lru 与 least_used_today 策略需要的使用情况
+		if !rec.LastUsedAt.IsZero() {
+			u := &keyUsage{LastUsed: rec.LastUsedAt, Day: today}
+			if days, err := store.usage(rec.Token, 1); err == nil {
+				u.Today = days[today].Requests
+			}
+			p.usage[rec.Token] = u
 		}
 	}
-	return keys, nil
+	for _, rec := range disabled {
+		p.disabled = append(p.disabled, rec.poolKey())
+	}
+	// 停机期间对秘钥文件的修改与运行时一样合并进秘钥库，之后再按秘钥库写出秘钥文件
+	p.mu.Lock()
+	p.syncFileLocked(cfg.Path)
+	p.writeFileLocked(p.keys)
+	p.mu.Unlock()
+
+	keyPool = p
+	log.Printf("Loaded %d keys from %s (%d disabled)", len(p.keys), cfg.Store, len(p.disabled))
+	return nil
 }
 
-// GetRandomKey 从指定的 key 文件中随机读取一个未被锁定的秘钥。
-// 如果当前没有可用秘钥，则会等待直到有秘钥被释放。
-// keyFilePath: key 文件的路径
-// 返回值:
-// selectedKey: 获取到的秘钥
-// err: 如果发生文件读取错误等，则返回错误
-func GetRandomKey(keyFilePath string, falseKeys []string) (selectedKey string, err error) {
-	// 在访问 statusMap 之前锁定 mutex
-	keyStatusMutex.Lock()
-	defer keyStatusMutex.Unlock() // 在函数退出时解锁
+// CloseKeyPool 关闭全局秘钥池的秘钥库，用于进程退出前，之后不再写出秘钥文件
+func CloseKeyPool() error {
+	keyPool.mu.Lock()
+	defer keyPool.mu.Unlock()
 
-	// 读取所有 key，以便知道总共有多少 key
-	// 注意：如果 key 文件内容可能变化，这里需要更复杂的处理
-	allKeys, err := getAllKeysFromFile(keyFilePath)
-	if err != nil {
-		// 即使文件读取失败，也需要解锁，否则会导致死锁
-		fmt.Errorf("failed to read all keys from file: %w", err)
+	keyPool.file = ""
+	if keyPool.store == nil {
+		return nil
+	}
+	err := keyPool.store.Close()
+	keyPool.store = nil
+	return err
+}
+
+// currentPoolConfig 返回当前生效的秘钥池配置，尚未加载配置时使用默认值
+func currentPoolConfig() PoolConfig {
+	if config := GetConfig(); config != nil {
+		return config.Pool
+	}
+	return PoolConfig{
+		Strategy:        strategyRandom,
+		MaxConcurrency:  1,
+		Cooldown:        10 * time.Second,
+		MaxCooldown:     5 * time.Minute,
+		QuarantineAfter: 3,
+		ProbeInterval:   10 * time.Minute,
+		DisableAfter:    6,
+	}
+}
+
+// Acquire 按 pool.strategy 取出一个还有空余并发的秘钥并计入使用中，用完后必须调用 Release
+// 如果当前没有可用秘钥，则进入公平队列等待：同一调用方先到先得，不同调用方轮流获取；
+// 排在前面的请求暂时取不到秘钥（例如点数不够）时，后面的请求按轮转顺序依次尝试，不会被它们挡住。
+// ctx 取消（客户端断开）或等待超过 opts.Timeout 时放弃等待并移出队列。
+// 没有秘钥时返回 ErrNoKeys，等待超时返回 ErrAcquireTimeout，ctx 取消时返回 ctx.Err()
+func (p *KeyPool) Acquire(ctx context.Context, opts AcquireOptions) (string, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, ErrAcquireTimeout)
+		defer cancel()
+	}
+	// ctx 结束时唤醒所有等待者，让对应的请求退出等待
+	// 广播前先获取锁，保证不会错过正在进入 Wait 的请求
+	stopWake := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+	defer stopWake()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.keys) == 0 {
+		// 池中根本没有 key，直接返回错误，避免无限等待
+		return "", ErrNoKeys
+	}
+	if p.allQuarantinedLocked() {
+		return "", ErrKeysQuarantined
+	}
+	if !p.anyAffordableLocked(opts.Cost) {
+		return "", ErrInsufficientAnlas
+	}
+	if err := ctx.Err(); err != nil {
+		return "", context.Cause(ctx)
 	}
 
-	if len(allKeys) == 0 {
-		// 如果文件中根本没有 key，直接返回错误，避免无限等待
-		fmt.Errorf("no valid keys found in the file: %s", keyFilePath)
+	// 没有人排队时直接取，有人排队时必须排在他们后面，避免插队
+	if p.queue.len() == 0 {
+		if key := p.pickLocked(opts); key != "" {
+			return key, nil
+		}
 	}
 
-	// 循环直到找到一个可用的 key
+	waiter := &keyWaiter{client: opts.Client, opts: opts}
+	p.queue.push(waiter)
+	log.Printf("所有Key都在使用中,请耐心等待其他 Key 值释放 (Total keys: %d, queued: %d)", len(p.keys), p.queue.len())
+
+	// leave 将请求移出队列并通知其余等待者位置已变化
+	leave := func() {
+		p.queue.remove(waiter, false)
+		p.cond.Broadcast()
+	}
+
+	reported := 0
 	for {
-		var availableKeys []string // 存储未被使用的秘钥
+		// 排队期间秘钥被全部删除或隔离时不再等待
+		if len(p.keys) == 0 {
+			leave()
+			return "", ErrNoKeys
+		}
+		if p.allQuarantinedLocked() {
+			leave()
+			return "", ErrKeysQuarantined
+		}
+		if !p.anyAffordableLocked(opts.Cost) {
+			leave()
+			return "", ErrInsufficientAnlas
+		}
+
+		// 轮到自己，或者排在前面的请求都取不到秘钥时才能取 key
+		if !p.servableAheadLocked(waiter) {
+			if key := p.pickLocked(opts); key != "" {
+				p.queue.remove(waiter, true)
+				// 队列发生变化，通知其余等待者检查是否轮到自己并更新排队位置
+				p.cond.Broadcast()
+				return key, nil
+			}
+		}
 
-		// 遍历所有 key，查找未被使用的
-		for _, key := range allKeys {
-			// 检查 map 中是否存在该 key，并且它的 value 是 false (未被使用)
-			if !keyStatusMap[keyStatusKey(key)] {
-				availableKeys = append(availableKeys, key) // 如果未被使用，添加到可用列表
+		// 排队位置变化时通知调用方，回调可能写网络，需要在锁外执行
+		if opts.OnQueue != nil {
+			if position := p.queue.position(waiter); position != reported {
+				reported = position
+				p.mu.Unlock()
+				opts.OnQueue(position)
+				p.mu.Lock()
+				continue
 			}
 		}
 
-		if len(availableKeys) > 0 {
-			// 如果有可用 key，随机选择一个
-			randomIndex := rand.Intn(len(availableKeys))
-			selectedKey = availableKeys[randomIndex]
+		// 客户端断开或等待超时
+		if ctx.Err() != nil {
+			leave()
+			return "", context.Cause(ctx)
+		}
+
+		p.cond.Wait() // 在这里等待，直到有key被释放、队列变化或 ctx 结束并广播
+	}
+}
+
+// pickLocked 按策略选择一个还有空余并发、状态正常且点数足够的秘钥并计入使用中，没有可用秘钥时返回空字符串
+// opts.Exclude 中的秘钥只在没有其他可用秘钥时才会被选中
+// 调用方需持有 mu
+func (p *KeyPool) pickLocked(opts AcquireOptions) string {
+	config := currentPoolConfig()
+	available := p.availableLocked(config, opts)
+	if len(available) == 0 {
+		return ""
+	}
 
-			// 将选中的 key 标记为正在使用
-			keyStatusMap[keyStatusKey(selectedKey)] = true
+	key := p.selectKeyLocked(config.Strategy, available)
+	p.inUse[key.Token]++
+	p.recordUseLocked(key)
+	return key.Token
+}
+
+// availableLocked 返回 opts 现在可以选用的秘钥，不修改任何状态，调用方需持有 mu
+func (p *KeyPool) availableLocked(config PoolConfig, opts AcquireOptions) []*poolKey {
+	var available, excluded []*poolKey
+	for _, key := range p.keys {
+		if p.inUse[key.Token] >= key.limit(config) || !p.usableLocked(key.Token) || !p.affordableLocked(key.Token, opts.Cost) {
+			continue
+		}
+		if slices.Contains(opts.Exclude, key.Token) {
+			excluded = append(excluded, key)
+		} else {
+			available = append(available, key)
+		}
+	}
+	if len(available) == 0 {
+		return excluded
+	}
+	return available
+}
 
-			// 返回获取到的 key
-			return selectedKey, nil
+// servableAheadLocked 判断按轮转顺序排在 waiter 之前的请求中是否有现在就能取到秘钥的，调用方需持有 mu
+// 没有时 waiter 可以先取，避免队首的请求因为点数不够等原因挡住后面所有请求
+func (p *KeyPool) servableAheadLocked(waiter *keyWaiter) bool {
+	config := currentPoolConfig()
+	for _, w := range p.queue.ordered() {
+		if w == waiter {
+			return false
+		}
+		if len(p.availableLocked(config, w.opts)) > 0 {
+			return true
 		}
+	}
+	return false
+}
+
+// indexLocked 返回秘钥在可用列表中的下标，不存在时返回 -1，调用方需持有 mu
+func (p *KeyPool) indexLocked(token string) int {
+	return indexKey(p.keys, token)
+}
+
+// Release 释放一个正在使用的秘钥，并通知等待者
+func (p *KeyPool) Release(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inUse[key] == 0 {
+		log.Printf("Attempted to release a key that was not in use: %s", maskSecret(key))
+		return
+	}
+	if p.inUse[key]--; p.inUse[key] == 0 {
+		delete(p.inUse, key)
+		// 已被移除的秘钥在最后一个请求结束后清理
+		p.forgetLocked(key)
+	}
+	p.cond.Broadcast()
+}
+
+// ReleaseAll 释放所有仍被标记为使用中的秘钥，用于进程退出前清理
+// 返回被释放的秘钥数量
+func (p *KeyPool) ReleaseAll() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		// 如果没有可用 key，释放锁并等待条件变量
-		// Wait 方法会自动释放锁并在收到 Signal 或 Broadcast 时再次获取锁
-		fmt.Printf("所有Key都在使用中,请耐心等待其他 Key 值释放 (Total keys: %d)\n", len(allKeys))
-
-		//// 将falseKeys的值拿一个出来
-		//if len(falseKeys) > 0 {
-		//	firstKey := falseKeys[0] // 取出第一个元素
-		//	fmt.Println("从列表中取出的一个key值强行解锁：", firstKey)
-		//	ReleaseKey(firstKey)
-		//} else {
-		//	fmt.Println("falseKeys 列表为空，无法取出值。")
-		//}
-
-		keyStatusCond.Wait() // 在这里等待，直到有key被释放并广播
-		// 当 Wait 返回时，表示有一个 key 状态发生变化，并且我们再次获取了锁。
-		// 循环会继续，重新检查是否有可用 key。
-		// 注意：Wait 返回后，你需要重新检查条件，因为可能有多个goroutine被唤醒，
-		// 并且在你的goroutine重新获取锁之前，其他goroutine已经获取了key。
-	}
-}
-
-// ReleaseKey 释放一个正在使用的秘钥，并通知等待者
-// key: 需要释放的秘钥字符串
-func ReleaseKey(key string) {
-	// 在访问 statusMap 之前锁定 mutex
-	keyStatusMutex.Lock()
-	defer keyStatusMutex.Unlock() // 在函数退出时解锁
-
-	// 将指定的 key 标记为未在使用
-	// 检查 key 是否真的被标记为使用中，更严谨
-	if keyStatusMap[keyStatusKey(key)] {
-		delete(keyStatusMap, keyStatusKey(key)) // 使用 delete 从 map 中移除 key
-		// 释放 key 后，通知一个或所有等待 GetRandomKey 的 goroutine
-		// keyStatusCond.Signal() // 通知一个等待者
-		keyStatusCond.Broadcast() // 通知所有等待者，如果你希望所有等待者都尝试获取key
-		fmt.Printf("Released key: %s. Notifying waiters.\n", key)
+	released := 0
+	for _, n := range p.inUse {
+		released += n
+	}
+	p.inUse = make(map[string]int)
+	p.cond.Broadcast()
+	return released
+}
+
+// Disable 将秘钥移出可用列表并记入失效列表，例如隔离后探测仍然失败时
+// 正在使用该秘钥的请求不受影响，释放后也不会再被选中
+func (p *KeyPool) Disable(key, reason string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	disabledKey := &poolKey{Token: key}
+	if i := p.indexLocked(key); i >= 0 {
+		disabledKey = p.keys[i]
 	} else {
-		fmt.Printf("Attempted to release a key that was not in use: %s\n", key)
+		log.Printf("Warning: key to disable not found in pool: %s", maskSecret(key))
+	}
+	keys := withoutKeys(p.keys, []string{key})
+	disabled := p.disabled
+	if indexKey(disabled, key) < 0 {
+		disabled = append(append([]*poolKey(nil), disabled...), disabledKey)
+	}
+
+	if err := p.saveLocked(keys, disabled, reason); err != nil {
+		return err
 	}
+	p.setListsLocked(keys, disabled)
+	p.transitionLocked(key, keyDisabled, reason)
+	return nil
 }
 
-// GetLockedKeys 用于获取当前被锁定的key列表 (可选，仅用于调试或监控)
-func GetLockedKeys() []string {
-	keyStatusMutex.Lock()
-	defer keyStatusMutex.Unlock()
+// Add 将秘钥加入可用列表，每项为秘钥文件中的一行（可带选项），已存在的秘钥会被忽略
+// 返回实际加入的数量
+func (p *KeyPool) Add(lines ...string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	var lockedKeys []string
-	for key, inUse := range keyStatusMap {
-		if inUse {
-			lockedKeys = append(lockedKeys, string(key))
+	keys := append([]*poolKey(nil), p.keys...)
+	for _, key := range parseKeyLines(lines) {
+		if indexKey(keys, key.Token) < 0 {
+			keys = append(keys, key)
 		}
 	}
-	return lockedKeys
+	added := len(keys) - len(p.keys)
+	if added == 0 {
+		return 0, nil
+	}
+	return added, p.setKeysLocked(keys)
 }
 
-// HandleUnauthorizedKey 将给定的 token 从 tokenFile 中删除，并添加到 errorTokenFile 中
-func HandleUnauthorizedKey(token string) error {
-	tokenFileMutex.Lock()
-	defer tokenFileMutex.Unlock()
+// Remove 将秘钥移出可用列表，返回实际移除的数量
+// 正在使用中的秘钥会在释放后自然失效
+func (p *KeyPool) Remove(tokens ...string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	tokenFile := viper.GetString("Nkey.path")
-	errorTokenFile := viper.GetString("Nkey.path_err")
+	keys := withoutKeys(p.keys, tokens)
+	removed := len(p.keys) - len(keys)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, p.setKeysLocked(keys)
+}
 
-	// 从 tokens 文件中读取所有 token
-	tokens, err := readTokens(tokenFile)
-	if err != nil {
-		return fmt.Errorf("failed to read tokens from %s: %w", tokenFile, err)
+// Replace 用给定的秘钥替换整个可用列表，每项为秘钥文件中的一行（可带选项）
+func (p *KeyPool) Replace(lines []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setKeysLocked(parseKeyLines(lines))
+}
+
+// setKeysLocked 写入秘钥库成功后替换内存中的可用列表，调用方需持有 mu
+// 重新加入的失效秘钥会移出失效列表
+func (p *KeyPool) setKeysLocked(keys []*poolKey) error {
+	tokens := make([]string, 0, len(keys))
+	for _, key := range keys {
+		tokens = append(tokens, key.Token)
 	}
+	disabled := withoutKeys(p.disabled, tokens)
+	if err := p.saveLocked(keys, disabled, ""); err != nil {
+		return err
+	}
+	// 重新加入的失效秘钥从正常状态开始
+	for _, key := range keys {
+		if st := p.status[key.Token]; st != nil && st.State == keyDisabled {
+			delete(p.status, key.Token)
+		}
+	}
+	p.setListsLocked(keys, disabled)
+	return nil
+}
 
-	// 找到并删除未授权的 token
-	foundAndRemoved := false
-	var updatedTokens []string
-	for _, t := range tokens {
-		if t == token {
-			foundAndRemoved = true
-			log.Printf("Removing unauthorized key from %s: %s", tokenFile, token)
-		} else {
-			updatedTokens = append(updatedTokens, t)
+// setListsLocked 替换内存中的可用与失效列表并通知等待者重新检查，调用方需持有 mu
+// 被移除的秘钥如果还有进行中的请求，会保留状态直到请求结束
+func (p *KeyPool) setListsLocked(keys, disabled []*poolKey) {
+	old := append(append([]*poolKey(nil), p.keys...), p.disabled...)
+	p.keys, p.disabled = keys, disabled
+	for _, key := range old {
+		p.forgetLocked(key.Token)
+	}
+	p.cond.Broadcast()
+}
+
+// forgetLocked 清理已不在池中且没有进行中请求的秘钥的状态与使用记录，调用方需持有 mu
+func (p *KeyPool) forgetLocked(token string) {
+	if p.inUse[token] > 0 || indexKey(p.keys, token) >= 0 || indexKey(p.disabled, token) >= 0 {
+		return
+	}
+	delete(p.status, token)
+	delete(p.usage, token)
+	delete(p.info, token)
+}
+
+// saveLocked 将可用与失效列表写入秘钥库并更新秘钥文件，reason 为新移入失效列表的原因，调用方需持有 mu
+// 秘钥库是唯一的数据来源，秘钥文件写入失败只记录日志
+func (p *KeyPool) saveLocked(keys, disabled []*poolKey, reason string) error {
+	if p.store != nil {
+		if err := p.store.sync(keys, disabled, reason); err != nil {
+			return fmt.Errorf("failed to save keys: %w", err)
 		}
 	}
+	p.writeFileLocked(keys)
+	return nil
+}
 
-	if !foundAndRemoved {
-		log.Printf("Warning: Unauthorized key not found in %s: %s", tokenFile, token)
-		// 如果未找到，可能已经处理过了，或者 Key 来源有问题
-		// 这里可以选择是返回错误还是继续添加到 error 文件，取决于你的需求
+// writeFileLocked 将可用秘钥写出到秘钥文件，内容没有变化时不写，避免触发文件监听，调用方需持有 mu
+func (p *KeyPool) writeFileLocked(keys []*poolKey) {
+	if p.file == "" {
+		return
 	}
+	lines := formatKeys(keys)
+	if current, err := readTokens(p.file); err == nil && slices.Equal(current, lines) {
+		return
+	}
+	if err := writeTokens(p.file, lines); err != nil {
+		log.Printf("Failed to write key file: %v", err)
+	}
+}
 
-	// 将更新后的 token 写回 tokens 文件
-	err = writeTokens(tokenFile, updatedTokens)
-	if err != nil {
-		return fmt.Errorf("failed to write updated tokens to %s: %w", tokenFile, err)
+// RecordUsage 在请求成功后记录秘钥当天的请求数与生成的图片张数，写入失败只记录日志
+func (p *KeyPool) RecordUsage(key string, images int) {
+	p.mu.Lock()
+	store := p.store
+	p.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+	if err := store.recordUsage(key, images, time.Now()); err != nil {
+		log.Printf("Failed to record usage of key %s: %v", maskSecret(key), err)
 	}
+}
 
-	// 将未授权的 token 追加到 errorTokens 文件
-	err = appendTokenToFile(errorTokenFile, token)
-	if err != nil {
-		return fmt.Errorf("failed to append unauthorized token to %s: %w", errorTokenFile, err)
+// Counts 返回可用秘钥总数与其中还有空余并发且状态正常的数量
+func (p *KeyPool) Counts() (total, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	config := currentPoolConfig()
+	for _, key := range p.keys {
+		if p.inUse[key.Token] < key.limit(config) && p.usableLocked(key.Token) {
+			idle++
+		}
 	}
+	return len(p.keys), idle
+}
 
-	return nil
+// InUse 返回当前被锁定的key列表 (仅用于调试或监控)
+func (p *KeyPool) InUse() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]string, 0, len(p.inUse))
+	for key := range p.inUse {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// DisabledKeys 返回失效秘钥列表
+func (p *KeyPool) DisabledKeys() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tokens := make([]string, 0, len(p.disabled))
+	for _, key := range p.disabled {
+		tokens = append(tokens, key.Token)
+	}
+	return tokens
+}
+
+// ReleaseAllKeys 释放全局秘钥池中所有仍被占用的秘钥，返回被释放的数量
+func ReleaseAllKeys() int {
+	return keyPool.ReleaseAll()
+}
+
+// parseKeyLines 解析上传或导入的秘钥各行，去掉空行与重复的秘钥，保持原有顺序
+// 选项有误的秘钥仍会保留，只记录日志
+func parseKeyLines(lines []string) []*poolKey {
+	keys := make([]*poolKey, 0, len(lines))
+	for _, line := range lines {
+		key, err := parseKeyLine(line)
+		if err != nil {
+			log.Printf("Ignoring key options: %v", err)
+		}
+		if key == nil || indexKey(keys, key.Token) >= 0 {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// formatKeys 将秘钥转换为秘钥文件中的各行
+func formatKeys(keys []*poolKey) []string {
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, key.String())
+	}
+	return lines
+}
+
+// withoutKeys 返回去掉 tokens 中所有秘钥后的新列表，tokens 可以是带选项的整行
+func withoutKeys(keys []*poolKey, tokens []string) []*poolKey {
+	drop := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		if fields := strings.Fields(token); len(fields) > 0 {
+			drop[fields[0]] = true
+		}
+	}
+	result := make([]*poolKey, 0, len(keys))
+	for _, key := range keys {
+		if !drop[key.Token] {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// indexKey 返回秘钥在列表中的下标，不存在时返回 -1
+func indexKey(keys []*poolKey, token string) int {
+	for i, key := range keys {
+		if key.Token == token {
+			return i
+		}
+	}
+	return -1
 }
 
 // readTokens 从指定文件读取所有非空行作为 token
@@ -248,28 +604,14 @@ func readTokens(filename string) ([]string, error) {
 	return tokens, nil
 }
 
-// writeTokens 将给定的 token 列表写入到指定文件，覆盖现有内容
+// writeTokens 将给定的 token 列表原子写入到指定文件，覆盖现有内容
 func writeTokens(filename string, tokens []string) error {
-	content := strings.Join(tokens, "\n") + "\n"             // 每行一个 token
-	err := ioutil.WriteFile(filename, []byte(content), 0644) // 0644 是标准的文件权限
-	if err != nil {
-		return fmt.Errorf("failed to write to file %s: %w", filename, err)
+	content := ""
+	if len(tokens) > 0 {
+		content = strings.Join(tokens, "\n") + "\n" // 每行一个 token
 	}
-	return nil
-}
-
-// appendTokenToFile 将给定的 token 追加到指定文件的末尾
-func appendTokenToFile(filename string, token string) error {
-	// O_APPEND 以追加模式打开，O_CREATE 如果文件不存在则创建，O_WRONLY 只写入
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open file %s for appending: %w", filename, err)
-	}
-	defer file.Close()
-
-	_, err = file.WriteString(token + "\n") // 追加 token 并换行
-	if err != nil {
-		return fmt.Errorf("failed to write token to file %s: %w", filename, err)
+	if err := writeFileAtomic(filename, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write to file %s: %w", filename, err)
 	}
 	return nil
 }
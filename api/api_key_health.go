@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// subscriptionTiers 是 NovelAI 订阅等级的名称
+var subscriptionTiers = map[int]string{0: "Paper", 1: "Tablet", 2: "Scroll", 3: "Opus"}
+
+// subscriptionResponse 是 /user/subscription 接口返回的部分字段
+type subscriptionResponse struct {
+	Tier              int   `json:"tier"`
+	Active            bool  `json:"active"`
+	ExpiresAt         int64 `json:"expiresAt"` // Unix 秒
+	TrainingStepsLeft struct {
+		FixedTrainingStepsLeft int `json:"fixedTrainingStepsLeft"` // 订阅每月赠送的点数
+		PurchasedTrainingSteps int `json:"purchasedTrainingSteps"` // 单独购买的点数
+	} `json:"trainingStepsLeft"`
+}
+
+// KeyInfo 是健康检查记录的秘钥订阅信息
+type KeyInfo struct {
+	Tier      int       `json:"tier"`
+	TierName  string    `json:"tier_name"`
+	Active    bool      `json:"active"` // 订阅是否有效
+	Anlas     int       `json:"anlas"`  // 剩余点数
+	ExpiresAt time.Time `json:"expires_at"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// fetchSubscription 使用订阅信息接口检查秘钥，非 200 响应以 *upstreamError 返回
+func fetchSubscription(ctx context.Context, key string) (*KeyInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, GetConfig().NovelAI.APIURL+novelAISubscriptionPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	var sub subscriptionResponse
+	if err := json.Unmarshal(body, &sub); err != nil {
+		return nil, fmt.Errorf("failed to parse subscription: %w", err)
+	}
+	info := &KeyInfo{
+		Tier:      sub.Tier,
+		TierName:  subscriptionTiers[sub.Tier],
+		Active:    sub.Active,
+		Anlas:     sub.TrainingStepsLeft.FixedTrainingStepsLeft + sub.TrainingStepsLeft.PurchasedTrainingSteps,
+		CheckedAt: time.Now(),
+	}
+	if sub.ExpiresAt > 0 {
+		info.ExpiresAt = time.Unix(sub.ExpiresAt, 0)
+	}
+	return info, nil
+}
+
+// probeKey 检查秘钥是否有效，成功时同时记录订阅信息
+func probeKey(ctx context.Context, key string) error {
+	info, err := fetchSubscription(ctx, key)
+	if err != nil {
+		return err
+	}
+	keyPool.SetInfo(key, info)
+	return nil
+}
+
+// SetInfo 记录秘钥的订阅信息，同时写入秘钥库，重启后仍可用于按点数选择秘钥
+func (p *KeyPool) SetInfo(key string, info *KeyInfo) {
+	p.mu.Lock()
+	p.info[key] = info
+	store := p.store
+	p.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+	if err := store.update(key, func(rec *KeyRecord) { rec.Info = info }); err != nil {
+		log.Printf("Failed to save info of key %s: %v", maskSecret(key), err)
+	}
+}
+
+// Info 返回秘钥最近一次检查到的订阅信息，没有检查过时返回 nil
+func (p *KeyPool) Info(key string) *KeyInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info[key]
+}
+
+// StartKeyHealthChecker 启动后台任务，每隔 pool.health_check_interval 检查一次所有秘钥
+// 间隔为 0 时不检查；修改配置后在下一轮生效
+func StartKeyHealthChecker(ctx context.Context) {
+	go func() {
+		for {
+			interval := currentPoolConfig().HealthCheckInterval
+			if interval > 0 {
+				keyPool.checkHealth(ctx)
+			} else {
+				// 未启用时也定期醒来，以便热加载开启后生效
+				interval = time.Minute
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// checkHealth 检查所有正常、冷却中的秘钥，隔离中的秘钥由探测任务负责
+// 401/403 的秘钥直接隔离；订阅失效且没有剩余点数的秘钥已无法画图，移入失效列表
+func (p *KeyPool) checkHealth(ctx context.Context) {
+	p.mu.Lock()
+	var keys []string
+	for _, key := range p.keys {
+		if st := p.status[key.Token]; st == nil || st.State != keyQuarantined {
+			keys = append(keys, key.Token)
+		}
+	}
+	p.mu.Unlock()
+
+	healthy := 0
+	for _, key := range keys {
+		info, err := fetchSubscription(ctx, key)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var upErr *upstreamError
+		switch {
+		case err == nil:
+			p.SetInfo(key, info)
+			if !info.Active && info.Anlas == 0 {
+				if err := p.Disable(key, "health check: subscription inactive and no Anlas left"); err != nil {
+					log.Printf("Failed to disable key: %v", err)
+				}
+				continue
+			}
+			healthy++
+		case errors.As(err, &upErr) && (upErr.Status == http.StatusUnauthorized || upErr.Status == http.StatusForbidden):
+			p.quarantine(key, fmt.Sprintf("health check: unauthorized (%d)", upErr.Status))
+		default:
+			// 网络错误等无法判断秘钥好坏，下一轮再检查
+			log.Printf("Health check of key %s failed: %v", maskSecret(key), err)
+		}
+	}
+	log.Printf("Key health check finished: %d/%d healthy", healthy, len(keys))
+}
+
+// quarantine 立即隔离秘钥，之后由探测任务定期探测
+func (p *KeyPool) quarantine(key, reason string) {
+	config := currentPoolConfig()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if indexKey(p.keys, key) >= 0 {
+		p.quarantineLocked(key, reason, config)
+	}
+}
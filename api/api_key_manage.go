@@ -0,0 +1,231 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrKeyNotFound 表示没有找到指定 id 的秘钥
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyView 是管理接口中展示、导出与导入的一个秘钥
+type KeyView struct {
+	ID             string    `json:"id"`
+	Token          string    `json:"token"`
+	State          keyState  `json:"state"`
+	Label          string    `json:"label,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	MaxConcurrency int       `json:"concurrency,omitempty"`
+	Weight         int       `json:"weight,omitempty"`
+	InUse          int       `json:"in_use"`
+	CooldownUntil  time.Time `json:"cooldown_until"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	AddedAt        time.Time `json:"added_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+	TotalRequests  int       `json:"total_requests"`
+	TotalImages    int       `json:"total_images"`
+	Today          DayUsage  `json:"today"`
+	Info           *KeyInfo  `json:"info,omitempty"`
+}
+
+// poolKey 返回导入时对应的秘钥池秘钥
+func (v *KeyView) poolKey() *poolKey {
+	return &poolKey{
+		Token:          strings.TrimSpace(v.Token),
+		MaxConcurrency: v.MaxConcurrency,
+		Weight:         v.Weight,
+		Label:          v.Label,
+		Owner:          v.Owner,
+	}
+}
+
+// Keys 返回所有可用与失效秘钥及其状态、元数据和用量，可用秘钥在前，均按加入顺序排列
+// 只在复制内存中的状态时持有 mu，读取秘钥库时不阻塞秘钥的获取与释放
+func (p *KeyPool) Keys() ([]KeyView, error) {
+	p.mu.Lock()
+	store := p.store
+	view := func(key *poolKey, state keyState) KeyView {
+		return KeyView{
+			ID:             keyID(key.Token),
+			Token:          key.Token,
+			State:          state,
+			Label:          key.Label,
+			Owner:          key.Owner,
+			MaxConcurrency: key.MaxConcurrency,
+			Weight:         key.Weight,
+			InUse:          p.inUse[key.Token],
+			Info:           p.info[key.Token],
+		}
+	}
+	views := make([]KeyView, 0, len(p.keys)+len(p.disabled))
+	for _, key := range p.keys {
+		state := keyActive
+		st := p.status[key.Token]
+		if st != nil {
+			state = st.State
+		}
+		v := view(key, state)
+		if state == keyCooling {
+			v.CooldownUntil = st.CooldownUntil
+		}
+		views = append(views, v)
+	}
+	for _, key := range p.disabled {
+		views = append(views, view(key, keyDisabled))
+	}
+	p.mu.Unlock()
+
+	if store == nil {
+		return views, nil
+	}
+	active, disabled, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*KeyRecord, len(active)+len(disabled))
+	for _, rec := range append(active, disabled...) {
+		records[rec.Token] = rec
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for i := range views {
+		v := &views[i]
+		if rec := records[v.Token]; rec != nil {
+			v.DisabledReason = rec.DisabledReason
+			v.AddedAt, v.LastUsedAt = rec.AddedAt, rec.LastUsedAt
+			v.TotalRequests, v.TotalImages = rec.TotalRequests, rec.TotalImages
+			if v.Info == nil {
+				v.Info = rec.Info
+			}
+		}
+		if days, err := store.usage(v.Token, 1); err == nil {
+			v.Today = days[today]
+		}
+	}
+	return views, nil
+}
+
+// findByIDLocked 按 id 查找秘钥，返回秘钥与它是否在失效列表中，没有找到时返回 nil，调用方需持有 mu
+func (p *KeyPool) findByIDLocked(id string) (key *poolKey, disabled bool) {
+	for _, key := range p.keys {
+		if keyID(key.Token) == id {
+			return key, false
+		}
+	}
+	for _, key := range p.disabled {
+		if keyID(key.Token) == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Activate 手动恢复秘钥：失效秘钥移回可用列表末尾，冷却或隔离中的秘钥立即恢复正常
+// 失败计数全部清零
+func (p *KeyPool) Activate(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, disabled := p.findByIDLocked(id)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	const reason = "re-activated by admin"
+
+	if !disabled {
+		st := p.statusLocked(key.Token)
+		st.AuthFailures, st.Strikes, st.ProbeFailures = 0, 0, 0
+		st.CooldownUntil = time.Time{}
+		p.transitionLocked(key.Token, keyActive, reason)
+		return nil
+	}
+
+	keys := append(append([]*poolKey(nil), p.keys...), key)
+	if err := p.setKeysLocked(keys); err != nil {
+		return err
+	}
+	p.recordTransitionLocked(key.Token, keyDisabled, keyActive, reason)
+	return nil
+}
+
+// Delete 从可用列表或失效列表中删除秘钥，正在使用中的秘钥会在释放后自然失效
+func (p *KeyPool) Delete(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, _ := p.findByIDLocked(id)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	tokens := []string{key.Token}
+	keys, disabled := withoutKeys(p.keys, tokens), withoutKeys(p.disabled, tokens)
+	if err := p.saveLocked(keys, disabled, ""); err != nil {
+		return err
+	}
+	p.setListsLocked(keys, disabled)
+	return nil
+}
+
+// Import 导入之前导出的秘钥，保留备注、选项以及是否失效，已存在的秘钥会被跳过
+// 导入用于恢复备份，不检查秘钥格式与是否过期
+func (p *KeyPool) Import(views []KeyView) (*UploadReport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := &UploadReport{
+		Mode:     "import",
+		Added:    []UploadResult{},
+		Removed:  []UploadResult{},
+		Skipped:  []UploadResult{},
+		Rejected: []UploadResult{},
+	}
+
+	keys := append([]*poolKey(nil), p.keys...)
+	disabled := append([]*poolKey(nil), p.disabled...)
+	reasons := make(map[string]string)
+	for i := range views {
+		key := views[i].poolKey()
+		switch {
+		case key.Token == "" || strings.ContainsAny(key.Token, " \t\r\n"):
+			report.Rejected = append(report.Rejected, uploadResult(key.Token, fmt.Sprintf("entry %d: invalid token", i+1)))
+			continue
+		case strings.ContainsAny(key.Label+key.Owner, " \t\r\n"):
+			report.Rejected = append(report.Rejected, uploadResult(key.Token, "label and owner must not contain spaces"))
+			continue
+		case indexKey(keys, key.Token) >= 0 || indexKey(disabled, key.Token) >= 0:
+			report.Skipped = append(report.Skipped, uploadResult(key.Token, "already exists"))
+			continue
+		}
+
+		state := keyActive
+		if views[i].State == keyDisabled {
+			state = keyDisabled
+			disabled = append(disabled, key)
+			reasons[key.Token] = views[i].DisabledReason
+		} else {
+			keys = append(keys, key)
+		}
+		report.Added = append(report.Added, uploadResult(key.Token, string(state)))
+	}
+	if len(report.Added) == 0 {
+		return report, nil
+	}
+
+	if err := p.saveLocked(keys, disabled, "imported"); err != nil {
+		return nil, err
+	}
+	p.setListsLocked(keys, disabled)
+	if p.store != nil {
+		for token, reason := range reasons {
+			if reason == "" {
+				continue
+			}
+			if err := p.store.update(token, func(rec *KeyRecord) { rec.DisabledReason = reason }); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
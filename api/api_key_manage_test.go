@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// viewTokens 返回 Keys 结果中的秘钥与状态，格式为 "token:state"
+func viewTokens(t *testing.T, p *KeyPool) []string {
+	t.Helper()
+	views, err := p.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, v := range views {
+		out = append(out, v.Token+":"+string(v.State))
+	}
+	return out
+}
+
+func TestKeysListsMetadata(t *testing.T) {
+	p := newStorePool(t, "a label=主力 owner=alice", "b")
+	if err := p.Disable("b", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+	p.RecordUsage("a", 4)
+
+	views, err := p.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 2 {
+		t.Fatalf("got %d keys, want 2", len(views))
+	}
+	a, b := views[0], views[1]
+	if a.ID != keyID("a") || a.State != keyActive || a.Label != "主力" || a.Owner != "alice" {
+		t.Errorf("a = %+v", a)
+	}
+	if a.TotalRequests != 1 || a.TotalImages != 4 || a.Today != (DayUsage{Requests: 1, Images: 4}) || a.AddedAt.IsZero() {
+		t.Errorf("a usage = %+v", a)
+	}
+	if b.State != keyDisabled || b.DisabledReason != "probe failed" {
+		t.Errorf("b = %+v", b)
+	}
+}
+
+func TestActivate(t *testing.T) {
+	useTestConfig(t, nil)
+	p := newStorePool(t, "a", "b")
+	if err := p.Disable("b", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+	reportAuthFailures(p, GetConfig().Pool.QuarantineAfter)
+
+	if err := p.Activate("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Activate(missing) = %v, want ErrKeyNotFound", err)
+	}
+	if got := viewTokens(t, p); !slices.Equal(got, []string{"a:quarantined", "b:disabled"}) {
+		t.Fatalf("before: %q", got)
+	}
+
+	// 隔离中的秘钥立即恢复，失效秘钥移回可用列表末尾
+	for _, token := range []string{"a", "b"} {
+		if err := p.Activate(keyID(token)); err != nil {
+			t.Fatalf("Activate(%s) = %v", token, err)
+		}
+	}
+	if got := viewTokens(t, p); !slices.Equal(got, []string{"a:active", "b:active"}) {
+		t.Errorf("after: %q", got)
+	}
+	if st := p.status["a"]; st.AuthFailures != 0 || st.Strikes != 0 {
+		t.Errorf("failure counters not reset: %+v", st)
+	}
+	if active, disabled := storeTokens(t, p.store); !slices.Equal(active, []string{"a", "b"}) || len(disabled) != 0 {
+		t.Errorf("store: active = %q, disabled = %q", active, disabled)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p := newStorePool(t, "a", "b")
+	if err := p.Disable("b", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"a", "b"} {
+		if err := p.Delete(keyID(token)); err != nil {
+			t.Fatalf("Delete(%s) = %v", token, err)
+		}
+	}
+	if err := p.Delete(keyID("a")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("second Delete(a) = %v, want ErrKeyNotFound", err)
+	}
+	if got := viewTokens(t, p); len(got) != 0 {
+		t.Errorf("keys left: %q", got)
+	}
+	if active, disabled := storeTokens(t, p.store); len(active)+len(disabled) != 0 {
+		t.Errorf("store: active = %q, disabled = %q", active, disabled)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := newStorePool(t, "a concurrency=2 label=主力", "b")
+	if err := src.Disable("b", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := src.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newStorePool(t, "a")
+	views := append(exported,
+		KeyView{Token: "bad token"},
+		KeyView{Token: "c", Owner: "bob smith"},
+	)
+	report, err := dst.Import(views)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reportIDs(report.Added); !slices.Equal(got, []string{keyID("b")}) {
+		t.Errorf("added = %v", got)
+	}
+	if got := reportIDs(report.Skipped); !slices.Equal(got, []string{keyID("a")}) {
+		t.Errorf("skipped = %v", got)
+	}
+	if len(report.Rejected) != 2 {
+		t.Errorf("rejected = %+v, want 2 entries", report.Rejected)
+	}
+
+	imported, err := dst.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || imported[1].Token != "b" || imported[1].State != keyDisabled || imported[1].DisabledReason != "probe failed" {
+		t.Errorf("imported = %+v", imported)
+	}
+}
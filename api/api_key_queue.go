@@ -0,0 +1,140 @@
+package api
+
+import "time"
+
+// AcquireOptions 描述获取秘钥的请求来自哪个调用方以及最多等待多久
+type AcquireOptions struct {
+	Client  string             // 调用方名称，用于在不同调用方之间轮转
+	Timeout time.Duration      // 排队等待的最长时间，0 表示只受 ctx 限制
+	Exclude []string           // 本次请求已经失败过的秘钥，有其他可用秘钥时不会被选中
+	Cost    *anlasCost         // 本次请求的点数估算，扣点的请求只会选中点数足够的秘钥；nil 表示不限制
+	OnQueue func(position int) // 排队位置变化时调用（不持有锁），可为 nil
+}
+
+// keyWaiter 是一个正在排队等待秘钥的请求
+type keyWaiter struct {
+	client string
+	opts   AcquireOptions // 用于判断它现在能否取到秘钥
+}
+
+// fairQueue 是等待秘钥的公平队列
+// 同一调用方的请求先到先得，不同调用方之间轮流获取秘钥，避免单个调用方的大量并发请求饿死其他调用方
+// 所有方法都需要在持有 KeyPool.mu 时调用
+type fairQueue struct {
+	queues map[string][]*keyWaiter // client => 该调用方排队中的请求
+	order  []string                // 有请求在排队的调用方，按轮转顺序排列
+	next   int                     // 下一个轮到的调用方在 order 中的下标
+}
+
+// newFairQueue 创建一个空的等待队列
+func newFairQueue() *fairQueue {
+	return &fairQueue{queues: make(map[string][]*keyWaiter)}
+}
+
+// len 返回排队中的请求数
+func (q *fairQueue) len() int {
+	n := 0
+	for _, waiters := range q.queues {
+		n += len(waiters)
+	}
+	return n
+}
+
+// push 将请求加入其调用方队列的末尾，新出现的调用方排在本轮的最后
+func (q *fairQueue) push(w *keyWaiter) {
+	if len(q.queues[w.client]) == 0 {
+		if len(q.order) == 0 {
+			q.order = append(q.order, w.client)
+			q.next = 0
+		} else {
+			// 插到当前轮到的调用方之前，即本轮最后一个
+			q.order = append(q.order[:q.next], append([]string{w.client}, q.order[q.next:]...)...)
+			q.next++
+		}
+	}
+	q.queues[w.client] = append(q.queues[w.client], w)
+}
+
+// remove 将请求移出队列，served 为 true 表示它已获得秘钥，轮转到下一个调用方
+func (q *fairQueue) remove(w *keyWaiter, served bool) {
+	index := -1
+	for i, client := range q.order {
+		if client == w.client {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return
+	}
+
+	waiters := q.queues[w.client]
+	for i, waiter := range waiters {
+		if waiter == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(q.queues, w.client)
+		q.order = append(q.order[:index], q.order[index+1:]...)
+		if index < q.next {
+			q.next--
+		}
+	} else {
+		q.queues[w.client] = waiters
+		if served && index == q.next {
+			q.next++
+		}
+	}
+	if q.next >= len(q.order) {
+		q.next = 0
+	}
+}
+
+// ordered 返回按轮转顺序排列的所有请求，即它们依次获取秘钥的顺序
+func (q *fairQueue) ordered() []*keyWaiter {
+	total := q.len()
+	waiters := make([]*keyWaiter, 0, total)
+	for round := 0; len(waiters) < total; round++ {
+		for i := range q.order {
+			if queued := q.queues[q.order[(q.next+i)%len(q.order)]]; round < len(queued) {
+				waiters = append(waiters, queued[round])
+			}
+		}
+	}
+	return waiters
+}
+
+// position 返回请求在轮转顺序下的排队位置，1 表示下一个获取秘钥
+func (q *fairQueue) position(w *keyWaiter) int {
+	waiters := q.queues[w.client]
+	rank := -1
+	for i, waiter := range waiters {
+		if waiter == w {
+			rank = i
+			break
+		}
+	}
+	if rank < 0 {
+		return 0
+	}
+
+	// 第 rank 轮轮到该请求，之前每个调用方最多排在它前面 rank 或 rank+1 个请求
+	position := rank + 1
+	before := true
+	for i := 0; i < len(q.order); i++ {
+		client := q.order[(q.next+i)%len(q.order)]
+		if client == w.client {
+			before = false
+			continue
+		}
+		limit := rank
+		if before {
+			limit = rank + 1
+		}
+		position += min(len(q.queues[client]), limit)
+	}
+	return position
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runQueue 按步骤操作一个公平队列并返回获得秘钥的顺序
+// 步骤为调用方名称时加入一个该调用方的请求（依次命名为 a1、a2……），
+// "serve" 让轮转顺序中的第一个请求获得秘钥，"cancel:a2" 让指定请求放弃排队，最后按队列顺序取完剩余请求
+func runQueue(t *testing.T, steps []string) []string {
+	t.Helper()
+	q := newFairQueue()
+	waiters := make(map[string]*keyWaiter)
+	names := make(map[*keyWaiter]string)
+	counts := make(map[string]int)
+	var served []string
+
+	serve := func() {
+		ordered := q.ordered()
+		if len(ordered) == 0 {
+			t.Fatalf("queue is empty")
+		}
+		w := ordered[0]
+		served = append(served, names[w])
+		q.remove(w, true)
+	}
+	for _, step := range steps {
+		switch {
+		case step == "serve":
+			serve()
+		case strings.HasPrefix(step, "cancel:"):
+			q.remove(waiters[strings.TrimPrefix(step, "cancel:")], false)
+		default:
+			counts[step]++
+			w := &keyWaiter{client: step}
+			name := fmt.Sprintf("%s%d", step, counts[step])
+			waiters[name], names[w] = w, name
+			q.push(w)
+		}
+	}
+	for q.len() > 0 {
+		serve()
+	}
+	return served
+}
+
+func TestFairQueueOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		want  []string
+	}{
+		{
+			name:  "one client is first come first served",
+			steps: []string{"a", "a", "a"},
+			want:  []string{"a1", "a2", "a3"},
+		},
+		{
+			name:  "clients take turns",
+			steps: []string{"a", "a", "a", "b"},
+			want:  []string{"a1", "b1", "a2", "a3"},
+		},
+		{
+			name:  "three clients rotate",
+			steps: []string{"a", "a", "b", "b", "c"},
+			want:  []string{"a1", "b1", "c1", "a2", "b2"},
+		},
+		{
+			name:  "new client joins at the end of the current round",
+			steps: []string{"a", "a", "b", "serve", "c"},
+			want:  []string{"a1", "b1", "a2", "c1"},
+		},
+		{
+			name:  "cancelling the head keeps the client's turn",
+			steps: []string{"a", "a", "b", "cancel:a1"},
+			want:  []string{"a2", "b1"},
+		},
+		{
+			name:  "cancelling a client's last request drops it from the rotation",
+			steps: []string{"a", "a", "b", "c", "cancel:b1"},
+			want:  []string{"a1", "c1", "a2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runQueue(t, tt.steps); !slices.Equal(got, tt.want) {
+				t.Errorf("served %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairQueuePosition(t *testing.T) {
+	q := newFairQueue()
+	var waiters []*keyWaiter
+	for _, client := range []string{"a", "a", "a", "b", "b"} {
+		w := &keyWaiter{client: client}
+		q.push(w)
+		waiters = append(waiters, w)
+	}
+
+	// 轮转顺序为 a1 b1 a2 b2 a3
+	want := []int{1, 3, 5, 2, 4}
+	for i, w := range waiters {
+		if got := q.position(w); got != want[i] {
+			t.Errorf("position of waiter %d (%s) = %d, want %d", i, w.client, got, want[i])
+		}
+	}
+	// ordered 与 position 一致
+	for i, w := range q.ordered() {
+		if got := q.position(w); got != i+1 {
+			t.Errorf("ordered()[%d] has position %d", i, got)
+		}
+	}
+	if got := q.position(&keyWaiter{client: "a"}); got != 0 {
+		t.Errorf("position of a request not in the queue = %d, want 0", got)
+	}
+}
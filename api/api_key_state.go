@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// keyState 是秘钥在池中的状态
+type keyState string
+
+const (
+	keyActive      keyState = "active"      // 正常使用
+	keyCooling     keyState = "cooling"     // 被限流 (429)，冷却结束后自动恢复
+	keyQuarantined keyState = "quarantined" // 连续 401，暂停使用并定期探测，探测成功后自动恢复
+	keyDisabled    keyState = "disabled"    // 已移入失效列表，需要手动恢复
+)
+
+// maxKeyTransitions 是内存中保留的状态变化记录条数
+const maxKeyTransitions = 500
+
+// keyProbeTick 是检查隔离秘钥是否到了探测时间的间隔
+const keyProbeTick = 30 * time.Second
+
+// keyStatus 记录秘钥的健康状态
+type keyStatus struct {
+	State         keyState
+	AuthFailures  int       // 连续 401 的次数，请求成功后清零
+	Strikes       int       // 连续被限流的次数，用于指数退避
+	CooldownUntil time.Time // 冷却结束时间
+	ProbeFailures int       // 隔离后连续探测失败的次数
+	NextProbe     time.Time // 下一次探测时间
+}
+
+// KeyTransition 记录一次秘钥状态变化
+type KeyTransition struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"` // 已隐藏中间部分
+	From   keyState  `json:"from"`
+	To     keyState  `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// statusLocked 返回秘钥的状态，不存在时视为正常，调用方需持有 mu
+func (p *KeyPool) statusLocked(key string) *keyStatus {
+	st := p.status[key]
+	if st == nil {
+		st = &keyStatus{State: keyActive}
+		p.status[key] = st
+	}
+	return st
+}
+
+// usableLocked 判断秘钥当前是否可以被选中，调用方需持有 mu
+func (p *KeyPool) usableLocked(key string) bool {
+	st := p.status[key]
+	return st == nil || st.State == keyActive
+}
+
+// allQuarantinedLocked 判断是否所有秘钥都处于隔离状态，调用方需持有 mu
+func (p *KeyPool) allQuarantinedLocked() bool {
+	for _, key := range p.keys {
+		if st := p.status[key.Token]; st == nil || st.State != keyQuarantined {
+			return false
+		}
+	}
+	return true
+}
+
+// transitionLocked 修改秘钥状态并记录，状态不变时什么也不做，调用方需持有 mu
+func (p *KeyPool) transitionLocked(key string, to keyState, reason string) {
+	st := p.statusLocked(key)
+	if st.State == to {
+		return
+	}
+
+	from := st.State
+	st.State = to
+	p.recordTransitionLocked(key, from, to, reason)
+}
+
+// recordTransitionLocked 记录一次状态变化，调用方需持有 mu
+func (p *KeyPool) recordTransitionLocked(key string, from, to keyState, reason string) {
+	t := KeyTransition{Time: time.Now(), Key: maskSecret(key), From: from, To: to, Reason: reason}
+	p.transitions = append(p.transitions, t)
+	if len(p.transitions) > maxKeyTransitions {
+		p.transitions = p.transitions[len(p.transitions)-maxKeyTransitions:]
+	}
+	log.Printf("Key %s: %s -> %s (%s)", t.Key, t.From, t.To, reason)
+
+	// 秘钥重新可用时唤醒等待者
+	if to == keyActive {
+		p.cond.Broadcast()
+	}
+}
+
+// Transitions 返回最近的秘钥状态变化记录，按时间先后排列
+func (p *KeyPool) Transitions() []KeyTransition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]KeyTransition(nil), p.transitions...)
+}
+
+// Cooldown 让秘钥在一段时间内不再被选中，返回冷却时长
+// retryAfter 大于 0 时使用 NovelAI 给出的时间，否则从 pool.cooldown 开始按连续被限流的次数翻倍，
+// 最长不超过 pool.max_cooldown
+func (p *KeyPool) Cooldown(key string, retryAfter time.Duration) time.Duration {
+	config := currentPoolConfig()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.statusLocked(key)
+	st.Strikes++
+
+	d := retryAfter
+	if d <= 0 {
+		d = config.Cooldown
+		for i := 1; i < st.Strikes && d < config.MaxCooldown; i++ {
+			d *= 2
+		}
+		d = min(d, config.MaxCooldown)
+	}
+	st.CooldownUntil = time.Now().Add(d)
+	// 已被隔离的秘钥不降级为冷却
+	if st.State == keyActive || st.State == keyCooling {
+		p.transitionLocked(key, keyCooling, "rate limited (429), cooling down for "+d.String())
+	}
+
+	// 冷却结束时恢复秘钥并唤醒等待者，否则所有秘钥都在冷却时排队的请求会一直等到超时
+	time.AfterFunc(d, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if st := p.status[key]; st != nil && st.State == keyCooling && !time.Now().Before(st.CooldownUntil) {
+			p.transitionLocked(key, keyActive, "cooldown expired")
+		}
+	})
+	return d
+}
+
+// MarkHealthy 在秘钥请求成功后清零失败计数，冷却中的秘钥立即恢复
+func (p *KeyPool) MarkHealthy(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.status[key]
+	if st == nil {
+		return
+	}
+	st.AuthFailures, st.Strikes = 0, 0
+	if st.State == keyCooling {
+		p.transitionLocked(key, keyActive, "request succeeded")
+	}
+}
+
+// ReportAuthFailure 记录一次 401，连续达到 pool.quarantine_after 次时隔离秘钥
+// 返回秘钥的新状态
+func (p *KeyPool) ReportAuthFailure(key string) keyState {
+	config := currentPoolConfig()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.statusLocked(key)
+	st.AuthFailures++
+	if st.AuthFailures >= config.QuarantineAfter {
+		p.quarantineLocked(key, "unauthorized (401) several times in a row", config)
+	}
+	return st.State
+}
+
+// quarantineLocked 隔离秘钥并安排第一次探测，已隔离时什么也不做，调用方需持有 mu
+func (p *KeyPool) quarantineLocked(key, reason string, config PoolConfig) {
+	st := p.statusLocked(key)
+	if st.State == keyQuarantined {
+		return
+	}
+	st.ProbeFailures = 0
+	st.NextProbe = time.Now().Add(config.ProbeInterval)
+	p.transitionLocked(key, keyQuarantined, reason)
+}
+
+// StartKeyProber 启动后台任务，定期探测被隔离的秘钥
+// 探测成功的秘钥恢复使用；连续 pool.disable_after 次探测仍返回 401 的秘钥移入失效列表
+// ctx 结束时停止
+func StartKeyProber(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(keyProbeTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				keyPool.probeQuarantined(ctx, probeKey)
+			}
+		}
+	}()
+}
+
+// probeQuarantined 探测所有到了探测时间的隔离秘钥
+func (p *KeyPool) probeQuarantined(ctx context.Context, probe func(ctx context.Context, key string) error) {
+	config := currentPoolConfig()
+
+	p.mu.Lock()
+	now := time.Now()
+	var due []string
+	for _, key := range p.keys {
+		if st := p.status[key.Token]; st != nil && st.State == keyQuarantined && !now.Before(st.NextProbe) {
+			due = append(due, key.Token)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, key := range due {
+		err := probe(ctx, key)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var upErr *upstreamError
+		unauthorized := errors.As(err, &upErr) && (upErr.Status == http.StatusUnauthorized || upErr.Status == http.StatusForbidden)
+
+		p.mu.Lock()
+		st := p.status[key]
+		if st == nil || st.State != keyQuarantined {
+			p.mu.Unlock()
+			continue
+		}
+		st.NextProbe = time.Now().Add(config.ProbeInterval)
+		switch {
+		case err == nil:
+			st.AuthFailures, st.ProbeFailures = 0, 0
+			p.transitionLocked(key, keyActive, "probe succeeded")
+		case unauthorized:
+			st.ProbeFailures++
+		default:
+			// 网络错误等无法判断秘钥好坏，下次再探测
+			log.Printf("Probe of key %s failed: %v", maskSecret(key), err)
+		}
+		disable := st.ProbeFailures >= config.DisableAfter
+		p.mu.Unlock()
+
+		if disable {
+			if err := p.Disable(key, "still unauthorized after repeated probes"); err != nil {
+				log.Printf("Failed to disable key: %v", err)
+			}
+		}
+	}
+}
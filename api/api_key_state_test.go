@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCooldownBackoff(t *testing.T) {
+	useTestConfig(t, func(c *Config) {
+		c.Pool.Cooldown = 10 * time.Second
+		c.Pool.MaxCooldown = 35 * time.Second
+	})
+
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{name: "first strike", want: 10 * time.Second},
+		{name: "second strike doubles", want: 20 * time.Second},
+		{name: "capped at max_cooldown", want: 35 * time.Second},
+		{name: "still capped", want: 35 * time.Second},
+		{name: "Retry-After wins", retryAfter: 7 * time.Second, want: 7 * time.Second},
+	}
+
+	// 各步骤依次作用在同一个秘钥上
+	p := newTestPool("a")
+	for _, tt := range tests {
+		if got := p.Cooldown("a", tt.retryAfter); got != tt.want {
+			t.Errorf("%s: Cooldown() = %s, want %s", tt.name, got, tt.want)
+		}
+		if st := p.status["a"]; st.State != keyCooling {
+			t.Errorf("%s: state = %s, want cooling", tt.name, st.State)
+		}
+	}
+
+	// 请求成功后清零并立即恢复
+	p.MarkHealthy("a")
+	if st := p.status["a"]; st.State != keyActive || st.Strikes != 0 {
+		t.Errorf("after MarkHealthy: %+v, want active with no strikes", st)
+	}
+	if got := p.Cooldown("a", 0); got != 10*time.Second {
+		t.Errorf("Cooldown after recovery = %s, want 10s", got)
+	}
+}
+
+func TestCooldownSkipsKey(t *testing.T) {
+	useTestConfig(t, func(c *Config) {
+		c.Pool.Cooldown = 20 * time.Millisecond
+		c.Pool.MaxCooldown = 20 * time.Millisecond
+	})
+
+	p := newTestPool("a")
+	p.Cooldown("a", 0)
+	p.mu.Lock()
+	picked := p.pickLocked(AcquireOptions{})
+	p.mu.Unlock()
+	if picked != "" {
+		t.Fatalf("picked %q while it was cooling down", picked)
+	}
+
+	// 冷却结束由定时器恢复，轮询等待而不是固定睡眠
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		picked = p.pickLocked(AcquireOptions{})
+		p.mu.Unlock()
+		if picked == "a" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("picked %q after the cooldown, want a", picked)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKeyStateTransitions(t *testing.T) {
+	unauthorized := &upstreamError{Status: http.StatusUnauthorized}
+
+	tests := []struct {
+		name   string
+		steps  func(p *KeyPool)
+		want   keyState
+		inPool bool // 是否仍在可用列表中
+	}{
+		{
+			name:   "auth failures below the threshold",
+			steps:  func(p *KeyPool) { p.ReportAuthFailure("a"); p.ReportAuthFailure("a") },
+			want:   keyActive,
+			inPool: true,
+		},
+		{
+			name: "success resets auth failures",
+			steps: func(p *KeyPool) {
+				p.ReportAuthFailure("a")
+				p.ReportAuthFailure("a")
+				p.MarkHealthy("a")
+				p.ReportAuthFailure("a")
+			},
+			want:   keyActive,
+			inPool: true,
+		},
+		{
+			name:   "quarantined after consecutive 401s",
+			steps:  func(p *KeyPool) { reportAuthFailures(p, 3) },
+			want:   keyQuarantined,
+			inPool: true,
+		},
+		{
+			name: "429 does not downgrade a quarantined key",
+			steps: func(p *KeyPool) {
+				reportAuthFailures(p, 3)
+				p.Cooldown("a", time.Minute)
+			},
+			want:   keyQuarantined,
+			inPool: true,
+		},
+		{
+			name: "successful probe restores the key",
+			steps: func(p *KeyPool) {
+				reportAuthFailures(p, 3)
+				probeNow(p, nil)
+			},
+			want:   keyActive,
+			inPool: true,
+		},
+		{
+			name: "network errors while probing keep the key quarantined",
+			steps: func(p *KeyPool) {
+				reportAuthFailures(p, 3)
+				for i := 0; i < 3; i++ {
+					probeNow(p, errors.New("connection refused"))
+				}
+			},
+			want:   keyQuarantined,
+			inPool: true,
+		},
+		{
+			name: "disabled after repeated unauthorized probes",
+			steps: func(p *KeyPool) {
+				reportAuthFailures(p, 3)
+				probeNow(p, unauthorized)
+				probeNow(p, unauthorized)
+			},
+			want:   keyDisabled,
+			inPool: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, func(c *Config) {
+				c.Pool.QuarantineAfter = 3
+				c.Pool.DisableAfter = 2
+			})
+			p := newStorePool(t, "a", "b")
+			tt.steps(p)
+
+			state := keyActive
+			if st := p.status["a"]; st != nil {
+				state = st.State
+			}
+			if state != tt.want {
+				t.Errorf("state = %s, want %s", state, tt.want)
+			}
+			if got := indexKey(p.keys, "a") >= 0; got != tt.inPool {
+				t.Errorf("key in pool = %v, want %v", got, tt.inPool)
+			}
+			if !tt.inPool && indexKey(p.disabled, "a") < 0 {
+				t.Errorf("removed key is not in the disabled list")
+			}
+		})
+	}
+}
+
+func TestAllQuarantined(t *testing.T) {
+	useTestConfig(t, func(c *Config) { c.Pool.QuarantineAfter = 1 })
+
+	p := newTestPool("a", "b")
+	p.ReportAuthFailure("a")
+	if _, err := p.Acquire(context.Background(), AcquireOptions{}); err != nil {
+		t.Fatalf("Acquire with one healthy key: %v", err)
+	}
+	p.ReportAuthFailure("b")
+	if _, err := p.Acquire(context.Background(), AcquireOptions{}); !errors.Is(err, ErrKeysQuarantined) {
+		t.Errorf("Acquire with all keys quarantined = %v, want ErrKeysQuarantined", err)
+	}
+}
+
+// reportAuthFailures 对秘钥 a 连续报告 n 次 401
+func reportAuthFailures(p *KeyPool, n int) {
+	for i := 0; i < n; i++ {
+		p.ReportAuthFailure("a")
+	}
+}
+
+// probeNow 立即探测隔离中的秘钥，探测结果为 err
+func probeNow(p *KeyPool, err error) {
+	p.mu.Lock()
+	for _, st := range p.status {
+		st.NextProbe = time.Time{}
+	}
+	p.mu.Unlock()
+	p.probeQuarantined(context.Background(), func(context.Context, string) error { return err })
+}
@@ -0,0 +1,377 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 秘钥库中的 bucket
+var (
+	storeKeysBucket     = []byte("keys")     // 秘钥 id => KeyRecord
+	storeUsageBucket    = []byte("usage")    // 秘钥 id => 子 bucket（日期 => DayUsage）
+	storeMetaBucket     = []byte("meta")     // 秘钥库自身的信息
+	storeAccountsBucket = []byte("accounts") // 账号 id => AccountRecord
+	storeImportedKey    = []byte("imported_at")
+)
+
+// keyUsageDays 是每个秘钥保留的每日用量天数，更早的记录在写入时清理
+const keyUsageDays = 90
+
+// KeyRecord 是秘钥库中保存的一个秘钥及其元数据
+type KeyRecord struct {
+	ID             string    `json:"id"` // 由秘钥计算出的固定短 id，可以公开展示
+	Token          string    `json:"token"`
+	Label          string    `json:"label,omitempty"`
+	Owner          string    `json:"owner,omitempty"`
+	MaxConcurrency int       `json:"concurrency,omitempty"`
+	Weight         int       `json:"weight,omitempty"`
+	Seq            uint64    `json:"seq"` // 加入顺序，加载时按此排序
+	Disabled       bool      `json:"disabled"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	DisabledAt     time.Time `json:"disabled_at"`
+	AddedAt        time.Time `json:"added_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+	TotalRequests  int       `json:"total_requests"`
+	TotalImages    int       `json:"total_images"`
+	Info           *KeyInfo  `json:"info,omitempty"` // 最近一次健康检查记录的订阅信息
+}
+
+// DayUsage 是秘钥一天内的用量
+type DayUsage struct {
+	Requests int `json:"requests"`
+	Images   int `json:"images"`
+}
+
+// keyStore 是保存秘钥、元数据与每日用量的单文件数据库
+type keyStore struct {
+	db *bolt.DB
+}
+
+// keyID 返回秘钥的短 id，不会泄露秘钥本身
+func keyID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// openKeyStore 打开（不存在时创建）秘钥库，另一个进程正在使用时 1 秒后返回错误
+func openKeyStore(path string) (*keyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{storeKeysBucket, storeUsageBucket, storeMetaBucket, storeAccountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize key store %s: %w", path, err)
+	}
+	return &keyStore{db: db}, nil
+}
+
+// Close 关闭秘钥库
+func (s *keyStore) Close() error {
+	return s.db.Close()
+}
+
+// importFiles 第一次启动时导入旧版的秘钥文件，之后不再读取它们
+// 返回是否进行了导入
+func (s *keyStore) importFiles(path, errPath string) (bool, error) {
+	var imported bool
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(storeMetaBucket).Get(storeImportedKey) != nil
+		return nil
+	}); err != nil || imported {
+		return false, err
+	}
+
+	active, err := readTokens(path)
+	if err != nil {
+		return false, err
+	}
+	disabled, err := readTokens(errPath)
+	if err != nil {
+		return false, err
+	}
+	// 同时出现在两个文件中的秘钥以失效为准
+	activeKeys := withoutKeys(parseKeyLines(active), disabled)
+	disabledKeys := parseKeyLines(disabled)
+
+	now := time.Now()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := syncKeys(tx, activeKeys, disabledKeys, "imported from "+errPath, now); err != nil {
+			return err
+		}
+		return tx.Bucket(storeMetaBucket).Put(storeImportedKey, []byte(now.Format(time.RFC3339)))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to import key files: %w", err)
+	}
+	log.Printf("Imported %d keys from %s and %d disabled keys from %s into the key store",
+		len(activeKeys), path, len(disabledKeys), errPath)
+	return true, nil
+}
+
+// load 读取所有秘钥，按加入顺序分为可用与失效两组
+func (s *keyStore) load() (active, disabled []*KeyRecord, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeKeysBucket).ForEach(func(_, v []byte) error {
+			var rec KeyRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if rec.Disabled {
+				disabled = append(disabled, &rec)
+			} else {
+				active = append(active, &rec)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load key store: %w", err)
+	}
+	bySeq := func(recs []*KeyRecord) {
+		sort.Slice(recs, func(i, j int) bool { return recs[i].Seq < recs[j].Seq })
+	}
+	bySeq(active)
+	bySeq(disabled)
+	return active, disabled, nil
+}
+
+// sync 让秘钥库与给定的可用、失效列表一致：新秘钥加入，已有秘钥保留元数据与用量，
+// 不在两个列表中的秘钥连同用量一起删除。reason 记录为新移入失效列表的原因
+func (s *keyStore) sync(active, disabled []*poolKey, reason string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return syncKeys(tx, active, disabled, reason, time.Now())
+	})
+}
+
+// syncKeys 在事务中执行 sync
+func syncKeys(tx *bolt.Tx, active, disabled []*poolKey, reason string, now time.Time) error {
+	keys := tx.Bucket(storeKeysBucket)
+	usage := tx.Bucket(storeUsageBucket)
+
+	keep := make(map[string]bool, len(active)+len(disabled))
+	put := func(key *poolKey, isDisabled bool) error {
+		id := keyID(key.Token)
+		keep[id] = true
+
+		rec := KeyRecord{ID: id, Token: key.Token, AddedAt: now}
+		if v := keys.Get([]byte(id)); v != nil {
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+		} else {
+			seq, err := keys.NextSequence()
+			if err != nil {
+				return err
+			}
+			rec.Seq = seq
+		}
+		rec.Label, rec.Owner = key.Label, key.Owner
+		rec.MaxConcurrency, rec.Weight = key.MaxConcurrency, key.Weight
+		switch {
+		case isDisabled && !rec.Disabled:
+			rec.Disabled, rec.DisabledReason, rec.DisabledAt = true, reason, now
+		case !isDisabled:
+			rec.Disabled, rec.DisabledReason, rec.DisabledAt = false, "", time.Time{}
+		}
+		return putRecord(keys, &rec)
+	}
+	for _, key := range active {
+		if err := put(key, false); err != nil {
+			return err
+		}
+	}
+	for _, key := range disabled {
+		if err := put(key, true); err != nil {
+			return err
+		}
+	}
+
+	// 删除不再存在的秘钥，ForEach 期间不能修改 bucket，先收集再删除
+	var stale [][]byte
+	if err := keys.ForEach(func(k, _ []byte) error {
+		if !keep[string(k)] {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := keys.Delete(k); err != nil {
+			return err
+		}
+		if usage.Bucket(k) != nil {
+			if err := usage.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// update 修改一个秘钥的记录，秘钥不存在时什么也不做
+func (s *keyStore) update(token string, fn func(rec *KeyRecord)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(storeKeysBucket)
+		v := keys.Get([]byte(keyID(token)))
+		if v == nil {
+			return nil
+		}
+		var rec KeyRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		fn(&rec)
+		return putRecord(keys, &rec)
+	})
+}
+
+// recordUsage 记录一次成功的请求及生成的图片张数
+// 使用 Batch 合并并发的写入，调用方不应持有秘钥池的锁
+func (s *keyStore) recordUsage(token string, images int, now time.Time) error {
+	id := []byte(keyID(token))
+	day := now.Format("2006-01-02")
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(storeKeysBucket)
+		v := keys.Get(id)
+		if v == nil {
+			// 秘钥已被删除
+			return nil
+		}
+		var rec KeyRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		rec.LastUsedAt = now
+		rec.TotalRequests++
+		rec.TotalImages += images
+		if err := putRecord(keys, &rec); err != nil {
+			return err
+		}
+
+		days, err := tx.Bucket(storeUsageBucket).CreateBucketIfNotExists(id)
+		if err != nil {
+			return err
+		}
+		var u DayUsage
+		if v := days.Get([]byte(day)); v != nil {
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+		}
+		u.Requests++
+		u.Images += images
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if err := days.Put([]byte(day), data); err != nil {
+			return err
+		}
+
+		// 日期按字典序即时间顺序排列，删除过期的记录
+		oldest := []byte(now.AddDate(0, 0, -keyUsageDays).Format("2006-01-02"))
+		c := days.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(oldest); k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// usage 返回秘钥最近 days 天的每日用量，键为 2006-01-02 格式的日期
+func (s *keyStore) usage(token string, days int) (map[string]DayUsage, error) {
+	result := make(map[string]DayUsage)
+	since := time.Now().AddDate(0, 0, -days+1).Format("2006-01-02")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storeUsageBucket).Bucket([]byte(keyID(token)))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(since)); k != nil; k, v = c.Next() {
+			var u DayUsage
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			result[string(k)] = u
+		}
+		return nil
+	})
+	return result, err
+}
+
+// loadAccounts 读取所有账号，按 id 排列
+func (s *keyStore) loadAccounts() ([]*AccountRecord, error) {
+	var accounts []*AccountRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeAccountsBucket).ForEach(func(_, v []byte) error {
+			var rec AccountRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			accounts = append(accounts, &rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// putAccount 保存一个账号
+func (s *keyStore) putAccount(rec *AccountRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeAccountsBucket).Put([]byte(rec.ID), data)
+	})
+}
+
+// deleteAccount 删除一个账号，账号不存在时什么也不做
+func (s *keyStore) deleteAccount(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(storeAccountsBucket).Delete([]byte(id))
+	})
+}
+
+// poolKey 返回记录对应的秘钥池秘钥
+func (rec *KeyRecord) poolKey() *poolKey {
+	return &poolKey{
+		Token:          rec.Token,
+		MaxConcurrency: rec.MaxConcurrency,
+		Weight:         rec.Weight,
+		Label:          rec.Label,
+		Owner:          rec.Owner,
+	}
+}
+
+// putRecord 将记录写入 keys bucket
+func putRecord(keys *bolt.Bucket, rec *KeyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return keys.Put([]byte(rec.ID), data)
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openTestStore 在临时目录中打开一个秘钥库，测试结束后关闭
+func openTestStore(t *testing.T) *keyStore {
+	t.Helper()
+	store, err := openKeyStore(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// storeTokens 返回秘钥库中按加入顺序排列的可用与失效秘钥
+func storeTokens(t *testing.T, store *keyStore) (active, disabled []string) {
+	t.Helper()
+	activeRecs, disabledRecs, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range activeRecs {
+		active = append(active, rec.Token)
+	}
+	for _, rec := range disabledRecs {
+		disabled = append(disabled, rec.Token)
+	}
+	return active, disabled
+}
+
+func TestKeyStoreImportsFilesOnce(t *testing.T) {
+	dir := t.TempDir()
+	path, errPath := filepath.Join(dir, "tokens"), filepath.Join(dir, "tokens_err")
+	if err := os.WriteFile(path, []byte("a concurrency=2\nb\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(errPath, []byte("c\nd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := openTestStore(t)
+
+	imported, err := store.importFiles(path, errPath)
+	if err != nil || !imported {
+		t.Fatalf("first importFiles() = %v, %v, want true, nil", imported, err)
+	}
+	// 同时出现在两个文件中的秘钥以失效为准
+	active, disabled := storeTokens(t, store)
+	if !slices.Equal(active, []string{"a", "b"}) || !slices.Equal(disabled, []string{"c", "d"}) {
+		t.Errorf("after import: active = %q, disabled = %q", active, disabled)
+	}
+	recs, _, _ := store.load()
+	if recs[0].MaxConcurrency != 2 || recs[0].ID != keyID("a") {
+		t.Errorf("options not imported: %+v", recs[0])
+	}
+
+	// 导入后秘钥文件不再被读取
+	if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imported, err = store.importFiles(path, errPath)
+	if err != nil || imported {
+		t.Fatalf("second importFiles() = %v, %v, want false, nil", imported, err)
+	}
+	if active, _ := storeTokens(t, store); !slices.Equal(active, []string{"a", "b"}) {
+		t.Errorf("second import changed the store: %q", active)
+	}
+}
+
+func TestKeyStoreSync(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.sync(parseKeyLines([]string{"a", "b", "c"}), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := store.recordUsage("a", 2, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.recordUsage("c", 1, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// b 移入失效列表，c 被删除，d 新加入，a 更新选项
+	if err := store.sync(parseKeyLines([]string{"d", "a weight=3"}), parseKeyLines([]string{"b"}), "401"); err != nil {
+		t.Fatal(err)
+	}
+
+	activeRecs, disabledRecs, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已有秘钥保持原来的加入顺序
+	if len(activeRecs) != 2 || activeRecs[0].Token != "a" || activeRecs[1].Token != "d" {
+		t.Fatalf("active = %+v, want a, d", activeRecs)
+	}
+	a := activeRecs[0]
+	if a.Weight != 3 || a.TotalRequests != 1 || a.TotalImages != 2 || a.LastUsedAt.IsZero() {
+		t.Errorf("a lost its metadata or options: %+v", a)
+	}
+	if len(disabledRecs) != 1 || disabledRecs[0].Token != "b" || disabledRecs[0].DisabledReason != "401" || disabledRecs[0].DisabledAt.IsZero() {
+		t.Errorf("disabled = %+v, want b with reason 401", disabledRecs)
+	}
+
+	day := now.Format("2006-01-02")
+	if days, err := store.usage("a", 1); err != nil || days[day] != (DayUsage{Requests: 1, Images: 2}) {
+		t.Errorf("usage(a) = %v, %v", days, err)
+	}
+	// 删除的秘钥连同用量一起删除
+	if days, err := store.usage("c", 1); err != nil || len(days) != 0 {
+		t.Errorf("usage(c) = %v, %v, want empty", days, err)
+	}
+
+	// 重新启用时清除失效原因
+	if err := store.sync(parseKeyLines([]string{"a", "d", "b"}), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	activeRecs, _, _ = store.load()
+	if b := activeRecs[1]; b.Token != "b" || b.Disabled || b.DisabledReason != "" {
+		t.Errorf("re-enabled b = %+v", b)
+	}
+}
+
+func TestKeyPoolPersistsToStore(t *testing.T) {
+	p := newStorePool(t, "a", "b")
+
+	if _, err := p.Add("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disable("a", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	active, disabled := storeTokens(t, p.store)
+	if !slices.Equal(active, []string{"c"}) || !slices.Equal(disabled, []string{"a"}) {
+		t.Errorf("store: active = %q, disabled = %q", active, disabled)
+	}
+}
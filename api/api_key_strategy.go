@@ -0,0 +1,191 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 秘钥选择策略，对应配置项 pool.strategy
+const (
+	strategyRandom         = "random"           // 在空闲秘钥中随机选择
+	strategyRoundRobin     = "round_robin"      // 按秘钥文件中的顺序轮流使用
+	strategyLRU            = "lru"              // 选择最久没有被使用的秘钥
+	strategyLeastUsedToday = "least_used_today" // 选择今天使用次数最少的秘钥
+	strategyWeighted       = "weighted"         // 按秘钥的权重随机选择
+)
+
+// keyStrategies 列出所有支持的选择策略
+var keyStrategies = []string{strategyRandom, strategyRoundRobin, strategyLRU, strategyLeastUsedToday, strategyWeighted}
+
+// poolKey 是秘钥池中的一个秘钥及其限制
+// 上传或导入时每行一个秘钥，可以在秘钥后追加空格分隔的选项，例如:
+//
+//	eyJhbGciOi... concurrency=2 weight=3 label=主力 owner=alice
+//
+// label 与 owner 不能包含空格
+type poolKey struct {
+	Token          string
+	MaxConcurrency int    // 最大并发请求数，0 表示使用 pool.max_concurrency
+	Weight         int    // weighted 策略下的权重，0 表示 1
+	Label          string // 备注
+	Owner          string // 秘钥的提供者
+}
+
+// parseKeyLine 解析秘钥文件中的一行，无法识别的选项会返回错误但秘钥本身仍然有效
+func parseKeyLine(line string) (*poolKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	key := &poolKey{Token: fields[0]}
+	var errs []string
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "label":
+			key.Label = value
+			continue
+		case "owner":
+			key.Owner = value
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Sprintf("invalid option %q", field))
+			continue
+		}
+		switch name {
+		case "concurrency":
+			key.MaxConcurrency = n
+		case "weight":
+			key.Weight = n
+		default:
+			errs = append(errs, fmt.Sprintf("unknown option %q", field))
+		}
+	}
+	if len(errs) > 0 {
+		return key, fmt.Errorf("key %s: %s", maskSecret(key.Token), strings.Join(errs, ", "))
+	}
+	return key, nil
+}
+
+// String 返回秘钥在文件中的一行，只写出非默认的选项
+func (k *poolKey) String() string {
+	line := k.Token
+	if k.MaxConcurrency > 0 {
+		line += fmt.Sprintf(" concurrency=%d", k.MaxConcurrency)
+	}
+	if k.Weight > 0 {
+		line += fmt.Sprintf(" weight=%d", k.Weight)
+	}
+	if k.Label != "" {
+		line += " label=" + k.Label
+	}
+	if k.Owner != "" {
+		line += " owner=" + k.Owner
+	}
+	return line
+}
+
+// limit 返回秘钥实际允许的并发数
+func (k *poolKey) limit(config PoolConfig) int {
+	if k.MaxConcurrency > 0 {
+		return k.MaxConcurrency
+	}
+	return config.MaxConcurrency
+}
+
+// weight 返回秘钥实际的权重
+func (k *poolKey) weight() int {
+	if k.Weight > 0 {
+		return k.Weight
+	}
+	return 1
+}
+
+// keyUsage 记录秘钥的使用情况，供 lru 与 least_used_today 策略使用
+type keyUsage struct {
+	LastUsed time.Time
+	Day      string // 2006-01-02
+	Today    int
+}
+
+// selectKeyLocked 按策略从空闲秘钥中选出一个，available 按秘钥文件中的顺序排列且不为空
+// 调用方需持有 mu
+func (p *KeyPool) selectKeyLocked(strategy string, available []*poolKey) *poolKey {
+	today := time.Now().Format("2006-01-02")
+	usage := func(key *poolKey) keyUsage {
+		if u := p.usage[key.Token]; u != nil {
+			if u.Day != today {
+				return keyUsage{LastUsed: u.LastUsed}
+			}
+			return *u
+		}
+		return keyUsage{}
+	}
+
+	switch strategy {
+	case strategyRoundRobin:
+		// 从上一次选中的秘钥之后开始找第一个空闲的
+		for _, key := range available {
+			if p.indexLocked(key.Token) > p.cursor {
+				return key
+			}
+		}
+		return available[0]
+
+	case strategyLRU:
+		best := available[0]
+		for _, key := range available[1:] {
+			if usage(key).LastUsed.Before(usage(best).LastUsed) {
+				best = key
+			}
+		}
+		return best
+
+	case strategyLeastUsedToday:
+		best := available[0]
+		for _, key := range available[1:] {
+			if usage(key).Today < usage(best).Today {
+				best = key
+			}
+		}
+		return best
+
+	case strategyWeighted:
+		total := 0
+		for _, key := range available {
+			total += key.weight()
+		}
+		n := rand.Intn(total)
+		for _, key := range available {
+			if n -= key.weight(); n < 0 {
+				return key
+			}
+		}
+		return available[len(available)-1]
+
+	default:
+		return available[rand.Intn(len(available))]
+	}
+}
+
+// recordUseLocked 记录秘钥被选中，调用方需持有 mu
+func (p *KeyPool) recordUseLocked(key *poolKey) {
+	now := time.Now()
+	u := p.usage[key.Token]
+	if u == nil {
+		u = &keyUsage{}
+		p.usage[key.Token] = u
+	}
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.Today = day, 0
+	}
+	u.LastUsed = now
+	u.Today++
+	p.cursor = p.indexLocked(key.Token)
+}
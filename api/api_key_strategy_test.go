@@ -0,0 +1,210 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *poolKey
+		wantErr string
+	}{
+		{name: "empty", line: "   ", want: nil},
+		{name: "token only", line: "pst-abc", want: &poolKey{Token: "pst-abc"}},
+		{
+			name: "all options",
+			line: "  pst-abc concurrency=2 weight=3 label=主力 owner=alice ",
+			want: &poolKey{Token: "pst-abc", MaxConcurrency: 2, Weight: 3, Label: "主力", Owner: "alice"},
+		},
+		{
+			name:    "invalid number keeps the key",
+			line:    "pst-abc concurrency=two weight=2",
+			want:    &poolKey{Token: "pst-abc", Weight: 2},
+			wantErr: `invalid option "concurrency=two"`,
+		},
+		{
+			name:    "negative number",
+			line:    "pst-abc weight=-1",
+			want:    &poolKey{Token: "pst-abc"},
+			wantErr: `invalid option "weight=-1"`,
+		},
+		{
+			name:    "unknown option",
+			line:    "pst-abc priority=1",
+			want:    &poolKey{Token: "pst-abc"},
+			wantErr: `unknown option "priority=1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyLine(tt.line)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseKeyLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+			// 写出后重新解析得到相同的秘钥
+			if got != nil && err == nil {
+				again, err := parseKeyLine(got.String())
+				if err != nil || *again != *got {
+					t.Errorf("round trip of %q = %+v, %v", got.String(), again, err)
+				}
+			}
+		})
+	}
+}
+
+// newTestPool 创建一个只在内存中的秘钥池
+func newTestPool(lines ...string) *KeyPool {
+	p := newKeyPool(nil)
+	p.keys = parseKeyLines(lines)
+	return p
+}
+
+func TestSelectKeyDeterministicStrategies(t *testing.T) {
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+
+	tests := []struct {
+		name     string
+		strategy string
+		cursor   int
+		usage    map[string]*keyUsage
+		want     string
+	}{
+		{name: "round robin starts at the first key", strategy: strategyRoundRobin, cursor: -1, want: "a"},
+		{name: "round robin continues after the cursor", strategy: strategyRoundRobin, cursor: 0, want: "b"},
+		{name: "round robin wraps around", strategy: strategyRoundRobin, cursor: 2, want: "a"},
+		{
+			name:     "lru prefers never used keys",
+			strategy: strategyLRU,
+			usage: map[string]*keyUsage{
+				"a": {LastUsed: now.Add(-time.Minute), Day: today},
+				"c": {LastUsed: now.Add(-time.Hour), Day: today},
+			},
+			want: "b",
+		},
+		{
+			name:     "lru picks the oldest",
+			strategy: strategyLRU,
+			usage: map[string]*keyUsage{
+				"a": {LastUsed: now.Add(-time.Minute), Day: today},
+				"b": {LastUsed: now.Add(-2 * time.Hour), Day: today},
+				"c": {LastUsed: now.Add(-time.Hour), Day: today},
+			},
+			want: "b",
+		},
+		{
+			name:     "least used today",
+			strategy: strategyLeastUsedToday,
+			usage: map[string]*keyUsage{
+				"a": {Day: today, Today: 5},
+				"b": {Day: today, Today: 2},
+				"c": {Day: today, Today: 3},
+			},
+			want: "b",
+		},
+		{
+			name:     "yesterday's usage does not count",
+			strategy: strategyLeastUsedToday,
+			usage: map[string]*keyUsage{
+				"a": {Day: today, Today: 1},
+				"b": {Day: today, Today: 2},
+				"c": {Day: yesterday, Today: 50},
+			},
+			want: "c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool("a", "b", "c")
+			p.cursor = tt.cursor
+			for token, u := range tt.usage {
+				p.usage[token] = u
+			}
+			if got := p.selectKeyLocked(tt.strategy, p.keys); got.Token != tt.want {
+				t.Errorf("selectKeyLocked(%s) = %s, want %s", tt.strategy, got.Token, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectKeyRoundRobinSkipsBusyKeys(t *testing.T) {
+	p := newTestPool("a", "b", "c")
+	p.cursor = 0
+	// b 正在使用中，不在候选列表里
+	available := []*poolKey{p.keys[0], p.keys[2]}
+	if got := p.selectKeyLocked(strategyRoundRobin, available); got.Token != "c" {
+		t.Errorf("selectKeyLocked = %s, want c", got.Token)
+	}
+}
+
+func TestSelectKeyWeighted(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  map[string]float64 // 期望的选中比例
+	}{
+		{name: "default weight is 1", lines: []string{"a", "b"}, want: map[string]float64{"a": 0.5, "b": 0.5}},
+		{name: "explicit weights", lines: []string{"a weight=1", "b weight=3"}, want: map[string]float64{"a": 0.25, "b": 0.75}},
+		{name: "zero means default", lines: []string{"a weight=0", "b weight=4"}, want: map[string]float64{"a": 0.2, "b": 0.8}},
+	}
+
+	const draws = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(tt.lines...)
+			counts := make(map[string]int)
+			for i := 0; i < draws; i++ {
+				counts[p.selectKeyLocked(strategyWeighted, p.keys).Token]++
+			}
+			for token, want := range tt.want {
+				if got := float64(counts[token]) / draws; got < want-0.03 || got > want+0.03 {
+					t.Errorf("key %s selected %.3f of the time, want about %.2f", token, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickLockedRespectsConcurrencyAndExclude(t *testing.T) {
+	useTestConfig(t, func(c *Config) {
+		c.Pool.Strategy = strategyRoundRobin
+		c.Pool.MaxConcurrency = 1
+	})
+
+	p := newTestPool("a concurrency=2", "b", "c")
+	var picked []string
+	for i := 0; i < 5; i++ {
+		picked = append(picked, p.pickLocked(AcquireOptions{}))
+	}
+	// a 可以同时服务两个请求，b、c 各一个，之后没有空余并发
+	if got := strings.Join(picked, ","); got != "a,b,c,a," {
+		t.Errorf("picked %s, want a,b,c,a,", got)
+	}
+
+	p.Release("b")
+	if got := p.pickLocked(AcquireOptions{}); got != "b" {
+		t.Errorf("pick after releasing b = %s, want b", got)
+	}
+
+	p = newTestPool("a", "b")
+	if got := p.pickLocked(AcquireOptions{Exclude: []string{"a"}}); got != "b" {
+		t.Errorf("pick with a excluded = %s, want b", got)
+	}
+	// 只剩被排除的秘钥时仍然可以选中
+	if got := p.pickLocked(AcquireOptions{Exclude: []string{"a"}}); got != "a" {
+		t.Errorf("pick with only excluded keys left = %s, want a", got)
+	}
+}
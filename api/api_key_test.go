@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newStorePool 创建一个秘钥库位于临时目录的秘钥池
+func newStorePool(t *testing.T, keys ...string) *KeyPool {
+	t.Helper()
+	store := openTestStore(t)
+	p := newKeyPool(store)
+	p.keys = parseKeyLines(keys)
+	if err := store.sync(p.keys, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAcquireNoKeys(t *testing.T) {
+	p := newStorePool(t)
+
+	// 没有秘钥时立即失败，而不是等到超时
+	start := time.Now()
+	_, err := p.Acquire(context.Background(), AcquireOptions{Timeout: time.Minute})
+	if !errors.Is(err, ErrNoKeys) {
+		t.Errorf("Acquire() = %v, want ErrNoKeys", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Acquire() took %s", elapsed)
+	}
+}
+
+func TestAcquireGivesUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    AcquireOptions
+		action  func(t *testing.T, p *KeyPool, cancel context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name:    "timeout",
+			opts:    AcquireOptions{Client: "b", Timeout: 20 * time.Millisecond},
+			action:  func(t *testing.T, p *KeyPool, cancel context.CancelFunc) {},
+			wantErr: ErrAcquireTimeout,
+		},
+		{
+			name:    "client cancels",
+			opts:    AcquireOptions{Client: "b"},
+			action:  func(t *testing.T, p *KeyPool, cancel context.CancelFunc) { cancel() },
+			wantErr: context.Canceled,
+		},
+		{
+			name: "all keys removed while waiting",
+			opts: AcquireOptions{Client: "b", Timeout: 5 * time.Second},
+			action: func(t *testing.T, p *KeyPool, cancel context.CancelFunc) {
+				if _, err := p.Remove("k1"); err != nil {
+					t.Error(err)
+				}
+			},
+			wantErr: ErrNoKeys,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStorePool(t, "k1")
+			if _, err := p.Acquire(context.Background(), AcquireOptions{Client: "a"}); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			action := tt.action
+			timer := time.AfterFunc(20*time.Millisecond, func() { action(t, p, cancel) })
+			defer timer.Stop()
+			_, err := p.Acquire(ctx, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Acquire() = %v, want %v", err, tt.wantErr)
+			}
+
+			// 放弃等待的请求必须离开队列，否则会挡住后面的请求
+			p.mu.Lock()
+			queued := p.queue.len()
+			p.mu.Unlock()
+			if queued != 0 {
+				t.Errorf("%d requests left in the queue", queued)
+			}
+		})
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	p := newStorePool(t, "k1")
+	key, err := p.Acquire(context.Background(), AcquireOptions{Client: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, func() { p.Release(key) })
+	got, err := p.Acquire(context.Background(), AcquireOptions{Client: "b", Timeout: 5 * time.Second})
+	if err != nil || got != "k1" {
+		t.Fatalf("Acquire() = %q, %v, want k1 after it is released", got, err)
+	}
+}
+
+func TestAcquireSkipsBlockedHead(t *testing.T) {
+	useTestConfig(t, nil)
+	paid := estimateCost(testPayload(1024, 1536, 28, 1, nil)) // 30 点
+	p := newTestPool("rich", "poor")
+	p.info = map[string]*KeyInfo{"rich": {Tier: 1, Anlas: 100}, "poor": {Tier: 1, Anlas: 0}}
+
+	// 两个秘钥都在使用中
+	for i := 0; i < 2; i++ {
+		if _, err := p.Acquire(context.Background(), AcquireOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			p.mu.Lock()
+			got := p.queue.len()
+			p.mu.Unlock()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("queue length = %d, want %d", got, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	type result struct {
+		key string
+		err error
+	}
+	acquire := func(opts AcquireOptions) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			key, err := p.Acquire(context.Background(), opts)
+			ch <- result{key, err}
+		}()
+		return ch
+	}
+
+	// 队首是只能用 rich 的扣点请求，后面是另一个调用方的免费请求
+	paidDone := acquire(AcquireOptions{Client: "x", Cost: &paid, Timeout: 5 * time.Second})
+	queued(1)
+	freeDone := acquire(AcquireOptions{Client: "y", Timeout: 5 * time.Second})
+	queued(2)
+
+	// poor 释放后队首用不了，免费请求不应被挡住
+	p.Release("poor")
+	select {
+	case r := <-freeDone:
+		if r.err != nil || r.key != "poor" {
+			t.Fatalf("free request = %q, %v, want poor", r.key, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("free request is blocked behind a paid request that cannot use the released key")
+	}
+
+	p.Release("rich")
+	if r := <-paidDone; r.err != nil || r.key != "rich" {
+		t.Fatalf("paid request = %q, %v, want rich", r.key, r.err)
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 上传模式，对应 /tokens/upload 请求中的 mode
+const (
+	uploadReplace = "replace" // 用上传的秘钥替换整个可用列表
+	uploadAppend  = "append"  // 在可用列表后追加新秘钥（默认）
+	uploadRemove  = "remove"  // 从可用列表与失效列表中删除秘钥
+)
+
+// uploadModes 列出所有支持的上传模式
+var uploadModes = []string{uploadAppend, uploadReplace, uploadRemove}
+
+// ErrReplaceRejected 表示替换上传中有被拒绝的行或没有任何可用的秘钥，秘钥池保持不变
+var ErrReplaceRejected = errors.New("replace upload refused: every line must be a valid token")
+
+// persistentTokenPrefix 是 NovelAI 持久 API 令牌的前缀，这类令牌不是 JWT，也没有过期时间
+const persistentTokenPrefix = "pst-"
+
+// UploadResult 是上传报告中的一项，秘钥已隐藏中间部分
+type UploadResult struct {
+	ID     string `json:"id"`
+	Token  string `json:"token"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// UploadReport 是一次上传的处理结果
+type UploadReport struct {
+	Mode     string         `json:"mode"`
+	Added    []UploadResult `json:"added"`    // 新加入可用列表
+	Removed  []UploadResult `json:"removed"`  // 从可用列表或失效列表中删除
+	Skipped  []UploadResult `json:"skipped"`  // 重复或不存在，没有变化
+	Rejected []UploadResult `json:"rejected"` // 格式不对或已过期，没有加入
+}
+
+// uploadResult 创建一项上传报告
+func uploadResult(token, reason string) UploadResult {
+	return UploadResult{ID: keyID(token), Token: maskSecret(token), Reason: reason}
+}
+
+// validateAccessToken 检查秘钥是否像一个可用的 NovelAI 访问令牌：
+// 持久 API 令牌 (pst-...) 只检查前缀；其余必须是未过期的 JWT，即三段 base64url，
+// 头部声明了 alg，载荷中有 exp
+func validateAccessToken(token string, now time.Time) error {
+	if strings.HasPrefix(token, persistentTokenPrefix) {
+		if len(token) == len(persistentTokenPrefix) {
+			return errors.New("empty persistent token")
+		}
+		return nil
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("not a JWT: expected 3 dot-separated parts, got %d", len(parts))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg == "" {
+		return errors.New("invalid JWT header: missing alg")
+	}
+
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid JWT payload: %w", err)
+	}
+	if claims.Exp == nil {
+		return errors.New("JWT has no exp claim")
+	}
+	if expiresAt := time.Unix(int64(*claims.Exp), 0); !now.Before(expiresAt) {
+		return fmt.Errorf("token expired at %s", expiresAt.Format(time.RFC3339))
+	}
+
+	if _, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil || parts[2] == "" {
+		return errors.New("invalid JWT signature")
+	}
+	return nil
+}
+
+// decodeJWTPart 解码 JWT 的一段 base64url JSON
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Upload 按 mode 处理上传的秘钥，每项为一行（可带选项），返回每个秘钥的处理结果
+// 新秘钥会与可用列表、失效列表以及本次上传的其他行去重；失效列表中的秘钥不会被重新加入
+// 替换时只要有一行被拒绝或没有任何可用的秘钥，就不做修改并返回报告与 ErrReplaceRejected，
+// 避免一次错误的上传清空整个秘钥池
+func (p *KeyPool) Upload(mode string, lines []string) (*UploadReport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := &UploadReport{
+		Mode:     mode,
+		Added:    []UploadResult{},
+		Removed:  []UploadResult{},
+		Skipped:  []UploadResult{},
+		Rejected: []UploadResult{},
+	}
+
+	if mode == uploadRemove {
+		var tokens []string
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			token := fields[0]
+			if indexKey(p.keys, token) < 0 && indexKey(p.disabled, token) < 0 {
+				report.Skipped = append(report.Skipped, uploadResult(token, "not found"))
+				continue
+			}
+			if !slices.Contains(tokens, token) {
+				tokens = append(tokens, token)
+				report.Removed = append(report.Removed, uploadResult(token, ""))
+			}
+		}
+		if len(tokens) == 0 {
+			return report, nil
+		}
+		keys, disabled := withoutKeys(p.keys, tokens), withoutKeys(p.disabled, tokens)
+		if err := p.saveLocked(keys, disabled, ""); err != nil {
+			return nil, err
+		}
+		p.setListsLocked(keys, disabled)
+		return report, nil
+	}
+
+	// 校验并去重上传的秘钥
+	now := time.Now()
+	var uploaded []*poolKey
+	for _, line := range lines {
+		key, err := parseKeyLine(line)
+		if key == nil {
+			continue
+		}
+		if err != nil {
+			report.Rejected = append(report.Rejected, uploadResult(key.Token, err.Error()))
+			continue
+		}
+		if err := validateAccessToken(key.Token, now); err != nil {
+			report.Rejected = append(report.Rejected, uploadResult(key.Token, err.Error()))
+			continue
+		}
+		switch {
+		case indexKey(uploaded, key.Token) >= 0:
+			report.Skipped = append(report.Skipped, uploadResult(key.Token, "duplicate in upload"))
+		case indexKey(p.disabled, key.Token) >= 0:
+			report.Skipped = append(report.Skipped, uploadResult(key.Token, "already in error list"))
+		default:
+			uploaded = append(uploaded, key)
+		}
+	}
+
+	var keys []*poolKey
+	switch mode {
+	case uploadAppend:
+		keys = append([]*poolKey(nil), p.keys...)
+		for _, key := range uploaded {
+			if indexKey(p.keys, key.Token) >= 0 {
+				report.Skipped = append(report.Skipped, uploadResult(key.Token, "already in pool"))
+				continue
+			}
+			keys = append(keys, key)
+			report.Added = append(report.Added, uploadResult(key.Token, ""))
+		}
+	case uploadReplace:
+		if len(uploaded) == 0 || len(report.Rejected) > 0 {
+			return report, ErrReplaceRejected
+		}
+		keys = uploaded
+		for _, key := range uploaded {
+			if indexKey(p.keys, key.Token) >= 0 {
+				report.Skipped = append(report.Skipped, uploadResult(key.Token, "already in pool, kept"))
+			} else {
+				report.Added = append(report.Added, uploadResult(key.Token, ""))
+			}
+		}
+		for _, key := range p.keys {
+			if indexKey(uploaded, key.Token) < 0 {
+				report.Removed = append(report.Removed, uploadResult(key.Token, "not in upload"))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown upload mode %q", mode)
+	}
+
+	if mode == uploadAppend && len(report.Added) == 0 {
+		return report, nil
+	}
+	if err := p.setKeysLocked(keys); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT 用给定的头部与载荷 JSON 拼出一个 JWT，签名固定
+func testJWT(header, payload string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(header)) + "." + enc([]byte(payload)) + "." + enc([]byte("signature"))
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	header := `{"alg":"HS256","typ":"JWT"}`
+	valid := testJWT(header, `{"id":"x","exp":1700003600}`)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "persistent token", token: "pst-abcdef"},
+		{name: "empty persistent token", token: "pst-", wantErr: "empty persistent token"},
+		{name: "valid JWT", token: valid},
+		{name: "padded base64 parts", token: strings.Replace(valid, ".", "==.", 1)},
+		{name: "not a JWT", token: "abcdef", wantErr: "expected 3 dot-separated parts, got 1"},
+		{name: "too many parts", token: valid + ".extra", wantErr: "got 4"},
+		{name: "header is not base64", token: "!!!." + strings.SplitN(valid, ".", 2)[1], wantErr: "invalid JWT header"},
+		{name: "header without alg", token: testJWT(`{"typ":"JWT"}`, `{"exp":1700003600}`), wantErr: "missing alg"},
+		{name: "payload is not JSON", token: testJWT(header, `not json`), wantErr: "invalid JWT payload"},
+		{name: "no exp", token: testJWT(header, `{"id":"x"}`), wantErr: "no exp claim"},
+		{name: "expired", token: testJWT(header, `{"exp":1699999999}`), wantErr: "token expired at"},
+		{name: "expires right now", token: testJWT(header, `{"exp":1700000000}`), wantErr: "token expired at"},
+		{name: "empty signature", token: strings.TrimSuffix(valid, base64.RawURLEncoding.EncodeToString([]byte("signature"))), wantErr: "invalid JWT signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccessToken(tt.token, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateAccessToken() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateAccessToken() = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// reportIDs 返回上传报告中各项的 id
+func reportIDs(results []UploadResult) []string {
+	ids := make([]string, 0, len(results))
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestKeyPoolUpload(t *testing.T) {
+	ids := func(tokens ...string) []string {
+		out := make([]string, 0, len(tokens))
+		for _, token := range tokens {
+			out = append(out, keyID(token))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name         string
+		mode         string
+		lines        []string
+		wantKeys     []string
+		wantAdded    []string
+		wantRemoved  []string
+		wantSkipped  []string
+		wantRejected []string
+		wantErr      error
+	}{
+		{
+			name:      "append skips existing and disabled keys",
+			mode:      uploadAppend,
+			lines:     []string{"pst-new", "pst-a", "pst-dead", "pst-new concurrency=2", "", "not-a-token"},
+			wantKeys:  []string{"pst-a", "pst-b", "pst-new"},
+			wantAdded: ids("pst-new"),
+			// 先报告上传内容中的重复与错误列表中的秘钥，再报告池中已有的秘钥
+			wantSkipped:  ids("pst-dead", "pst-new", "pst-a"),
+			wantRejected: ids("not-a-token"),
+		},
+		{
+			name:        "replace keeps listed keys and removes the rest",
+			mode:        uploadReplace,
+			lines:       []string{"pst-b", "pst-new"},
+			wantKeys:    []string{"pst-b", "pst-new"},
+			wantAdded:   ids("pst-new"),
+			wantRemoved: ids("pst-a"),
+			wantSkipped: ids("pst-b"),
+		},
+		{
+			name:         "replace with a rejected line changes nothing",
+			mode:         uploadReplace,
+			lines:        []string{"pst-new", "not-a-token"},
+			wantKeys:     []string{"pst-a", "pst-b"},
+			wantRejected: ids("not-a-token"),
+			wantErr:      ErrReplaceRejected,
+		},
+		{
+			name:        "replace without valid keys changes nothing",
+			mode:        uploadReplace,
+			lines:       []string{"", "pst-dead"},
+			wantKeys:    []string{"pst-a", "pst-b"},
+			wantSkipped: ids("pst-dead"),
+			wantErr:     ErrReplaceRejected,
+		},
+		{
+			name:         "options are validated",
+			mode:         uploadAppend,
+			lines:        []string{"pst-new weight=heavy"},
+			wantKeys:     []string{"pst-a", "pst-b"},
+			wantRejected: ids("pst-new"),
+		},
+		{
+			name:        "remove from both lists",
+			mode:        uploadRemove,
+			lines:       []string{"pst-a", "pst-dead extra", "pst-missing", "pst-a"},
+			wantKeys:    []string{"pst-b"},
+			wantRemoved: ids("pst-a", "pst-dead"),
+			wantSkipped: ids("pst-missing"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool("pst-a", "pst-b")
+			p.disabled = parseKeyLines([]string{"pst-dead"})
+
+			report, err := p.Upload(tt.mode, tt.lines)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Upload() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var keys []string
+			for _, key := range p.keys {
+				keys = append(keys, key.Token)
+			}
+			if !slices.Equal(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+			for _, check := range []struct {
+				name string
+				got  []UploadResult
+				want []string
+			}{
+				{"added", report.Added, tt.wantAdded},
+				{"removed", report.Removed, tt.wantRemoved},
+				{"skipped", report.Skipped, tt.wantSkipped},
+				{"rejected", report.Rejected, tt.wantRejected},
+			} {
+				got := reportIDs(check.got)
+				if !slices.Equal(got, check.want) && !(len(got) == 0 && len(check.want) == 0) {
+					t.Errorf("%s = %v, want %v", check.name, got, check.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleUploadTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantKeys   []string
+		wantMode   string
+	}{
+		{
+			name:       "append is the default mode",
+			body:       `{"tokens":["pst-new"]}`,
+			wantStatus: http.StatusOK,
+			wantKeys:   []string{"pst-a", "pst-new"},
+			wantMode:   uploadAppend,
+		},
+		{
+			name:       "refused replace returns the report",
+			body:       `{"tokens":["not-a-token"],"mode":"replace"}`,
+			wantStatus: http.StatusBadRequest,
+			wantKeys:   []string{"pst-a"},
+			wantMode:   uploadReplace,
+		},
+		{
+			name:       "empty replace is refused",
+			body:       `{"tokens":[],"mode":"replace"}`,
+			wantStatus: http.StatusBadRequest,
+			wantKeys:   []string{"pst-a"},
+			wantMode:   uploadReplace,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := keyPool
+			keyPool = newTestPool("pst-a")
+			t.Cleanup(func() { keyPool = old })
+
+			rec := httptest.NewRecorder()
+			HandleUploadTokens(rec, httptest.NewRequest(http.MethodPost, "/tokens/upload", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			var report UploadReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+				t.Fatalf("response is not a report: %s", rec.Body.String())
+			}
+			if report.Mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", report.Mode, tt.wantMode)
+			}
+			if got := formatKeys(keyPool.keys); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("keys = %q, want %q", got, tt.wantKeys)
+			}
+		})
+	}
+}
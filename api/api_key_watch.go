@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// keyFileReloadDelay 用于合并编辑器保存时产生的多次写事件
+const keyFileReloadDelay = 300 * time.Millisecond
+
+// WatchKeyFile 监听秘钥文件 (Nkey.path)，被外部修改后重新加载可用秘钥
+// 返回的函数用于停止监听
+func WatchKeyFile(path string) (stop func(), err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file watcher: %w", err)
+	}
+
+	// 与配置文件一样监听所在目录，编辑器"写临时文件再重命名"的保存方式也能被捕获
+	target := filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(target)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch key directory: %w", err)
+	}
+
+	// timer 由监听 goroutine 创建、由 stop 取消，stopped 之后不再安排重新加载
+	var (
+		mu      sync.Mutex
+		timer   *time.Timer
+		stopped bool
+	)
+	reload := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			keyPool.reloadFile(path)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target {
+					continue
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+					continue
+				}
+				mu.Lock()
+				if timer != nil {
+					timer.Stop()
+				}
+				if !stopped {
+					timer = time.AfterFunc(keyFileReloadDelay, reload)
+				}
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Key file watcher error: %v", err)
+			}
+		}
+	}()
+
+	// stop 取消尚未触发的重新加载，并等待正在进行的重新加载完成
+	return func() {
+		watcher.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if timer != nil {
+			timer.Stop()
+		}
+	}, nil
+}
+
+// reloadFile 按秘钥文件的内容更新可用列表，秘钥池自己写出的内容不会引起变化
+// 仍然存在的秘钥保留使用中、冷却与隔离等状态；被删除的秘钥不再被选中，进行中的请求结束后清理；
+// 文件中出现的失效秘钥会被重新启用
+func (p *KeyPool) reloadFile(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// 秘钥池已关闭
+	if p.file == "" {
+		return
+	}
+	p.syncFileLocked(path)
+}
+
+// syncFileLocked 将秘钥文件与可用列表对比，有差异时以文件为准写入秘钥库并记录增删的秘钥，调用方需持有 mu
+// 文件不存在时保留当前秘钥，清空秘钥需要把文件改为空
+func (p *KeyPool) syncFileLocked(path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("Key file %s was removed, keeping the current keys", path)
+		return
+	}
+	lines, err := readTokens(path)
+	if err != nil {
+		log.Printf("Failed to reload key file: %v", err)
+		return
+	}
+
+	keys := parseKeyLines(lines)
+	if slices.Equal(formatKeys(keys), formatKeys(p.keys)) {
+		return
+	}
+
+	var added, removed []string
+	changed := 0
+	now := time.Now()
+	for _, key := range keys {
+		i := p.indexLocked(key.Token)
+		switch {
+		case i < 0:
+			added = append(added, maskSecret(key.Token))
+			if err := validateAccessToken(key.Token, now); err != nil {
+				log.Printf("Warning: key %s from %s looks invalid: %v", maskSecret(key.Token), path, err)
+			}
+		case p.keys[i].String() != key.String():
+			changed++
+		}
+	}
+	for _, key := range p.keys {
+		if indexKey(keys, key.Token) < 0 {
+			removed = append(removed, maskSecret(key.Token))
+		}
+	}
+
+	if err := p.setKeysLocked(keys); err != nil {
+		log.Printf("Failed to apply key file changes: %v", err)
+		return
+	}
+	log.Printf("Reloaded keys from %s: %d added, %d removed, %d changed (%d total)", path, len(added), len(removed), changed, len(keys))
+	if len(added) > 0 {
+		log.Printf("Keys added from %s: %s", path, strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		log.Printf("Keys removed by %s: %s", path, strings.Join(removed, ", "))
+	}
+}
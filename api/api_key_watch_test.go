@@ -0,0 +1,224 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newMirroredPool 创建一个同时写出秘钥文件的秘钥池，返回秘钥池与秘钥文件路径
+func newMirroredPool(t *testing.T, keys ...string) (*KeyPool, string) {
+	t.Helper()
+	p := newStorePool(t, keys...)
+	p.file = filepath.Join(t.TempDir(), "tokens")
+	p.writeFileLocked(p.keys)
+	return p, p.file
+}
+
+func TestKeyPoolWritesKeyFile(t *testing.T) {
+	p, path := newMirroredPool(t, "a concurrency=2", "b")
+
+	if _, err := p.Add("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disable("b", "probe failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 失效秘钥不写入秘钥文件，选项随秘钥一起写出
+	lines, err := readTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a concurrency=2", "c"}; !slices.Equal(lines, want) {
+		t.Errorf("key file = %q, want %q", lines, want)
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string // 为空表示删除秘钥文件
+		wantKeys     []string
+		wantDisabled []string
+		wantStatus   bool // a 的冷却状态是否保留
+	}{
+		{
+			name:         "unchanged file keeps state",
+			content:      "a\nb\n",
+			wantKeys:     []string{"a", "b"},
+			wantDisabled: []string{"dead"},
+			wantStatus:   true,
+		},
+		{
+			name:         "added, removed and changed keys",
+			content:      "a weight=5\nc\n",
+			wantKeys:     []string{"a weight=5", "c"},
+			wantDisabled: []string{"dead"},
+			wantStatus:   true,
+		},
+		{
+			name:         "disabled key is re-enabled",
+			content:      "a\nb\ndead\n",
+			wantKeys:     []string{"a", "b", "dead"},
+			wantDisabled: nil,
+			wantStatus:   true,
+		},
+		{
+			name:         "removed file keeps the current keys",
+			wantKeys:     []string{"a", "b"},
+			wantDisabled: []string{"dead"},
+			wantStatus:   true,
+		},
+		{
+			name:         "emptied file removes every key",
+			content:      "\n",
+			wantKeys:     nil,
+			wantDisabled: []string{"dead"},
+			wantStatus:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestConfig(t, nil)
+			p, path := newMirroredPool(t, "a", "b", "dead")
+			if err := p.Disable("dead", "probe failed"); err != nil {
+				t.Fatal(err)
+			}
+			p.Cooldown("a", 0)
+
+			if tt.content == "" {
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p.reloadFile(path)
+
+			if got := formatKeys(p.keys); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("keys = %q, want %q", got, tt.wantKeys)
+			}
+			if got := formatKeys(p.disabled); !slices.Equal(got, tt.wantDisabled) {
+				t.Errorf("disabled = %q, want %q", got, tt.wantDisabled)
+			}
+			if _, ok := p.status["a"]; ok != tt.wantStatus {
+				t.Errorf("status of a kept = %v, want %v", ok, tt.wantStatus)
+			}
+			// 重新加载的结果同样写入秘钥库
+			active, _ := storeTokens(t, p.store)
+			if len(active) != len(tt.wantKeys) {
+				t.Errorf("store has %d active keys, want %d", len(active), len(tt.wantKeys))
+			}
+		})
+	}
+}
+
+func TestReloadFileKeepsInUseKeyState(t *testing.T) {
+	useTestConfig(t, nil)
+	p, path := newMirroredPool(t, "a", "b")
+	p.mu.Lock()
+	p.inUse["a"] = 1
+	p.mu.Unlock()
+	p.Cooldown("a", 0)
+
+	if err := os.WriteFile(path, []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.reloadFile(path)
+
+	// 被删除但仍在使用的秘钥保留状态，直到最后一个请求结束
+	p.mu.Lock()
+	_, kept := p.status["a"]
+	p.mu.Unlock()
+	if !kept {
+		t.Fatal("state of an in-use key was dropped on reload")
+	}
+	p.Release("a")
+	p.mu.Lock()
+	_, kept = p.status["a"]
+	p.mu.Unlock()
+	if kept {
+		t.Error("state of a removed key was kept after release")
+	}
+}
+
+func TestInitKeyPoolMergesKeyFile(t *testing.T) {
+	old := keyPool
+	t.Cleanup(func() { keyPool = old })
+
+	dir := t.TempDir()
+	cfg := NkeyConfig{
+		Store:   filepath.Join(dir, "tokens.db"),
+		Path:    filepath.Join(dir, "tokens"),
+		PathErr: filepath.Join(dir, "tokens_err"),
+	}
+	start := func(t *testing.T) {
+		t.Helper()
+		if err := InitKeyPool(cfg); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { CloseKeyPool() })
+	}
+	writeFile := func(t *testing.T, content string) {
+		t.Helper()
+		if err := os.WriteFile(cfg.Path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		edit     func(t *testing.T) // 两次启动之间对秘钥文件的修改
+		wantKeys []string
+	}{
+		{
+			name:     "first start imports the file",
+			edit:     func(t *testing.T) { writeFile(t, "a\nb\n") },
+			wantKeys: []string{"a", "b"},
+		},
+		{
+			name:     "edits made while stopped are merged",
+			edit:     func(t *testing.T) { writeFile(t, "b\n\nc   weight=2\n") },
+			wantKeys: []string{"b", "c weight=2"},
+		},
+		{
+			name: "removed file is written again from the store",
+			edit: func(t *testing.T) {
+				if err := os.Remove(cfg.Path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantKeys: []string{"b", "c weight=2"},
+		},
+	}
+
+	// 各个用例依次重启同一个秘钥库
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.edit(t)
+			start(t)
+
+			if got := formatKeys(keyPool.keys); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("keys = %q, want %q", got, tt.wantKeys)
+			}
+			var wantTokens []string
+			for _, key := range parseKeyLines(tt.wantKeys) {
+				wantTokens = append(wantTokens, key.Token)
+			}
+			if active, _ := storeTokens(t, keyPool.store); !slices.Equal(active, wantTokens) {
+				t.Errorf("store = %q, want %q", active, wantTokens)
+			}
+			// 秘钥文件按秘钥库重新写出
+			lines, err := readTokens(cfg.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(lines, tt.wantKeys) {
+				t.Errorf("key file = %q, want %q", lines, tt.wantKeys)
+			}
+		})
+	}
+}
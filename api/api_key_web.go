@@ -1,24 +1,23 @@
 package api
 
 import (
-	"bufio"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/spf13/viper"
 	"io"
+	"log"
 	"net/http"
-
-	// 为了方便演示，这里假设 tokens 文件路径是固定的
-	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// 假设你的 key 文件路径
-
-const tokensFilePath = "keys/tokens" // 或者根据你的需求配置
-
 // TokensUploadRequest 用于接收前端上传的 tokens 数据
 type TokensUploadRequest struct {
 	Tokens []string `json:"tokens"`
+	Mode   string   `json:"mode"` // append（默认）、replace 或 remove
 }
 
 // CountResponse 用于返回 Tokens 数量
@@ -33,12 +32,7 @@ type ErrorTokensResponse struct {
 
 // HandleUploadTokens 处理前端上传 Tokens 的请求
 func HandleUploadTokens(w http.ResponseWriter, r *http.Request) {
-	// 假设这里需要一些认证或权限验证（根据实际情况添加）
-	// if !isAuthenticated(r) {
-	//     http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	//     return
-	// }
-
+	// 认证由 AdminAuth 中间件完成
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -57,158 +51,311 @@ func HandleUploadTokens(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if req.Mode == "" {
+		req.Mode = uploadAppend
+	}
+	if !slices.Contains(uploadModes, req.Mode) {
+		http.Error(w, fmt.Sprintf("mode must be one of %s", strings.Join(uploadModes, ", ")), http.StatusBadRequest)
+		return
+	}
 
-	// 将接收到的 tokens 写入文件
-	// 注意：这里直接覆盖了原有文件内容。如果你想追加或合并，需要更复杂的逻辑。
-	// 同时需要考虑并发写入的问题，可能需要一个文件锁。
-
-	keys := viper.GetString("Nkey.path")
-
-	file, err := os.OpenFile(keys, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// 由秘钥池校验、去重并写入秘钥库，被移除的秘钥如果正在使用会在释放后自然失效
+	report, err := keyPool.Upload(req.Mode, req.Tokens)
+	if errors.Is(err, ErrReplaceRejected) {
+		// 返回报告，调用方可以看到是哪些行被拒绝
+		writeJSON(w, http.StatusBadRequest, report)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to open tokens file for writing: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to save tokens: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	writeJSON(w, http.StatusOK, report)
+}
 
-	writer := bufio.NewWriter(file)
-	for _, token := range req.Tokens {
-		_, err := writer.WriteString(token + "\n")
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to write token to file: %v", err), http.StatusInternalServerError)
-			return
-		}
+// HandleGetAvailableTokensCount 处理获取可用 Tokens 数量的请求
+func HandleGetAvailableTokensCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	err = writer.Flush()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to flush tokens file: %v", err), http.StatusInternalServerError)
+	// 直接使用秘钥池内存中的状态，不再读取文件；还有空余并发的秘钥视为可用
+	_, availableKeysCount := keyPool.Counts()
+
+	resp := CountResponse{Count: availableKeysCount}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleClearTokens 处理清空 Tokens 的请求（需要你实现清空逻辑）
+func HandleClearTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// 清空当前的 keyStatusMap，以便重新加载和标记密钥
-	keyStatusMutex.Lock()
-	// 清空 map
-	for k := range keyStatusMap {
-		delete(keyStatusMap, k)
+	// 清空秘钥池，由秘钥池负责写回文件并通知等待者
+	if err := keyPool.Replace(nil); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to clear tokens: %v", err), http.StatusInternalServerError)
+		return
 	}
-	// 在实际应用中，这里应该重新加载文件并更新 keyStatusMap
-	// 但为了简化，这里只是清空 map，下一次 GetRandomKey 会重新加载文件
 
-	keyStatusMutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Tokens cleared successfully"))
+}
+
+// HandleGetErrorTokens 处理获取错误 Tokens 的请求（需要你实现错误 Tokens 的存储和管理）
+// Token 默认隐藏中间部分，?reveal=true 时返回完整 Token
+func HandleGetErrorTokens(w http.ResponseWriter, r *http.Request) {
+	// 失效 Token 由秘钥池维护
+	errorTokens := keyPool.DisabledKeys()
+	if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); !reveal {
+		for i := range errorTokens {
+			errorTokens[i] = maskSecret(errorTokens[i])
+		}
+	}
 
-	// 通知等待者（如果有）密钥列表可能已更新
-	keyStatusCond.Broadcast()
+	// 构建要返回给前端的 JSON 结构
+	resp := struct {
+		Errors []string `json:"errors"` // 匹配前端预期的 "errors" 键
+	}{
+		Errors: errorTokens,
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Tokens uploaded successfully"))
+	w.Header().Set("Content-Type", "application/json")
+	// 设置响应头，允许跨域访问（如果前端和后端不在同一个域）
+	// w.Header().Set("Access-Control-Allow-Origin", "*") // 仅用于开发测试，生产环境请指定具体的允许来源
+	json.NewEncoder(w).Encode(resp)
 }
 
-// HandleGetAvailableTokensCount 处理获取可用 Tokens 数量的请求
-func HandleGetAvailableTokensCount(w http.ResponseWriter, r *http.Request) {
-	// 假设这里不需要认证
+// KeyTransitionsResponse 用于返回秘钥状态变化记录
+type KeyTransitionsResponse struct {
+	Transitions []KeyTransition `json:"transitions"`
+}
 
+// HandleKeyTransitions 返回最近的秘钥状态变化记录（秘钥已隐藏）
+func HandleKeyTransitions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	writeJSON(w, http.StatusOK, KeyTransitionsResponse{Transitions: keyPool.Transitions()})
+}
 
-	// 在访问 keyStatusMap 之前锁定 mutex
-	keyStatusMutex.Lock()
-	defer keyStatusMutex.Unlock()
-
-	// 从文件中读取所有 key
-	keys := viper.GetString("Nkey.path")
+// KeysResponse 用于返回所有秘钥及其状态
+type KeysResponse struct {
+	Keys []KeyView `json:"keys"`
+}
 
-	allKeys, fileErr := getAllKeysFromFile(keys) // Reuse your existing function
-	if fileErr != nil {
-		// 文件读取失败，返回 0 或错误
-		http.Error(w, fmt.Sprintf("Failed to read tokens file: %v", fileErr), http.StatusInternalServerError)
-		// unlock is deferred
+// HandleListKeys 返回所有可用与失效秘钥的状态、元数据与用量
+// 秘钥默认隐藏中间部分，?reveal=true 时返回完整秘钥
+func HandleListKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	totalKeys := len(allKeys)
-	lockedKeysCount := 0
-	// 统计被锁定的 key 数量
-	for _, key := range allKeys {
-		if keyStatusMap[keyStatusKey(key)] {
-			lockedKeysCount++
+	keys, err := keyPool.Keys()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if reveal, _ := strconv.ParseBool(r.URL.Query().Get("reveal")); !reveal {
+		for i := range keys {
+			keys[i].Token = maskSecret(keys[i].Token)
 		}
 	}
+	writeJSON(w, http.StatusOK, KeysResponse{Keys: keys})
+}
 
-	availableKeysCount := totalKeys - lockedKeysCount
+// HandleKey 按 id 管理单个秘钥
+// DELETE /tokens/keys/{id} 删除，POST /tokens/keys/{id}/activate 恢复
+func HandleKey(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/tokens/keys/"), "/")
+	if id == "" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
 
-	resp := CountResponse{Count: availableKeysCount}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	var err error
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		err = keyPool.Delete(id)
+	case action == "activate" && r.Method == http.MethodPost:
+		err = keyPool.Activate(id)
+	case action == "" || action == "activate":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if errors.Is(err, ErrKeyNotFound) {
+		http.Error(w, fmt.Sprintf("Key %s not found", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update key: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// HandleClearTokens 处理清空 Tokens 的请求（需要你实现清空逻辑）
-func HandleClearTokens(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
+// keyCSVHeader 是导出与导入 CSV 的列
+var keyCSVHeader = []string{"id", "token", "state", "label", "owner", "concurrency", "weight", "disabled_reason",
+	"added_at", "last_used_at", "total_requests", "total_images"}
+
+// HandleExportTokens 导出整个秘钥池（包含完整秘钥），?format=json（默认）或 csv
+func HandleExportTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
 
-	// 清空文件内容
-	keys := viper.GetString("Nkey.path")
-
-	file, err := os.OpenFile(keys, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	keys, err := keyPool.Keys()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to clear tokens file: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to export keys: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
-	// 文件已被截断，内容已经被清空
+	filename := fmt.Sprintf("tokens-%s.%s", time.Now().Format("20060102-150405"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
 
-	// 清空内存中的 keyStatusMap
-	keyStatusMutex.Lock()
-	for k := range keyStatusMap {
-		delete(keyStatusMap, k)
+	if format == "json" {
+		writeJSON(w, http.StatusOK, KeysResponse{Keys: keys})
+		return
 	}
-	keyStatusMutex.Unlock()
-
-	// 通知等待者（如果有）
-	keyStatusCond.Broadcast()
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Tokens cleared successfully"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write(keyCSVHeader)
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	for _, key := range keys {
+		cw.Write([]string{key.ID, key.Token, string(key.State), key.Label, key.Owner,
+			strconv.Itoa(key.MaxConcurrency), strconv.Itoa(key.Weight), key.DisabledReason,
+			formatTime(key.AddedAt), formatTime(key.LastUsedAt), strconv.Itoa(key.TotalRequests), strconv.Itoa(key.TotalImages)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("写入 CSV 失败: %v", err)
+	}
 }
 
-// HandleGetErrorTokens 处理获取错误 Tokens 的请求（需要你实现错误 Tokens 的存储和管理）
-func HandleGetErrorTokens(w http.ResponseWriter, r *http.Request) {
-	// 获取错误 Token 文件的路径
-	// 假设 viper 配置中保存了文件路径，例如 "Nkey.path_err"
-	// 您需要确保 viper 已经初始化并加载了配置
-	errorTokensFilePath := viper.GetString("Nkey.path_err")
-	if errorTokensFilePath == "" {
-		// 如果 viper 配置没有找到路径，或者路径为空，返回错误
-		http.Error(w, "Error tokens file path not configured", http.StatusInternalServerError)
+// HandleImportTokens 导入由 HandleExportTokens 导出的 JSON 或 CSV，已存在的秘钥会被跳过
+// 格式由 ?format= 指定，未指定时 Content-Type 为 text/csv 的请求按 CSV 解析
+func HandleImportTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		}
+	}
 
-	// 从文件中读取所有 Token
-	// 注意：这里假设 `keys/tokens_err` 文件中的所有 Token 都是“错误”的
-	// 如果您有额外的逻辑来判断哪些是错误 Token，您需要修改 getAllKeysFromFile 或在读取后进行过滤
-	errorTokens, fileErr := getAllKeysFromFile(errorTokensFilePath)
-	if fileErr != nil {
-		// 文件读取失败，返回错误给客户端
-		http.Error(w, fmt.Sprintf("Failed to read error tokens file: %v", fileErr), http.StatusInternalServerError)
+	body := http.MaxBytesReader(w, r.Body, 10<<20)
+	var keys []KeyView
+	switch format {
+	case "json":
+		var req KeysResponse
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		keys = req.Keys
+	case "csv":
+		var err error
+		if keys, err = readKeysCSV(body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid CSV: %v", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
 		return
 	}
 
-	// 构建要返回给前端的 JSON 结构
-	resp := struct {
-		Errors []string `json:"errors"` // 匹配前端预期的 "errors" 键
-	}{
-		Errors: errorTokens,
+	report, err := keyPool.Import(keys)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to import keys: %v", err), http.StatusInternalServerError)
+		return
 	}
+	writeJSON(w, http.StatusOK, report)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	// 设置响应头，允许跨域访问（如果前端和后端不在同一个域）
-	// w.Header().Set("Access-Control-Allow-Origin", "*") // 仅用于开发测试，生产环境请指定具体的允许来源
-	json.NewEncoder(w).Encode(resp)
+// readKeysCSV 按表头读取导出的 CSV，只需要 token 列，其余列可以省略
+func readKeysCSV(r io.Reader) ([]KeyView, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	if _, ok := columns["token"]; !ok {
+		return nil, errors.New("missing token column")
+	}
+
+	var keys []KeyView
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) (int, error) {
+			if v := field(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 {
+					return 0, fmt.Errorf("line %d: invalid %s %q", line, name, v)
+				}
+				return n, nil
+			}
+			return 0, nil
+		}
+
+		key := KeyView{
+			Token:          field("token"),
+			State:          keyState(field("state")),
+			Label:          field("label"),
+			Owner:          field("owner"),
+			DisabledReason: field("disabled_reason"),
+		}
+		if key.MaxConcurrency, err = number("concurrency"); err != nil {
+			return nil, err
+		}
+		if key.Weight, err = number("weight"); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
 }
 
 // 在你的主应用中注册这些处理函数
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// contextKey 是存放在请求 context 中的值的键类型
+type contextKey string
+
+// requestIDKey 用于在 context 中保存请求 id
+const requestIDKey contextKey = "request_id"
+
+// RequestID 返回请求的 id，没有经过 Recover 包装的请求返回空字符串
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID 生成一个随机的请求 id
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// trackingWriter 记录响应头是否已经写出，同时保留 Flush 能力供 SSE 使用
+type trackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (t *trackingWriter) WriteHeader(status int) {
+	t.wroteHeader = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *trackingWriter) Write(b []byte) (int, error) {
+	t.wroteHeader = true
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *trackingWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (t *trackingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Recover 为请求分配 id，并在处理函数 panic 时记录日志并返回 500，避免整个进程退出
+func Recover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		tw := &trackingWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			// ErrAbortHandler 是 net/http 约定的中断方式，交给 http.Server 处理
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			log.Printf("[%s] panic serving %s %s: %v\n%s", id, r.Method, r.URL.Path, rec, debug.Stack())
+			if tw.wroteHeader {
+				// 响应已经开始，无法再修改状态码
+				return
+			}
+			writeError(tw, errInternal("Internal server error (request id: %s)", id))
+		}()
+
+		next(tw, r)
+	}
+}
+
+// AdminAuth 校验管理接口秘钥，支持 Authorization: Bearer <secret> 与 X-Admin-Token 两种请求头
+// admin.secret 为空（例如热加载后被清空）时拒绝所有请求，不会退回使用 sk.key
+func AdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Admin-Token")
+		if token == "" {
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		secret := GetConfig().Admin.Secret
+		if token == "" || secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			log.Printf("[%s] Admin authentication failed for %s %s from %s", RequestID(r), r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, errInvalidAPIKey())
+			return
+		}
+		next(w, r)
+	}
+}
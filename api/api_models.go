@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// 图生图默认的重绘强度
+const defaultImg2ImgStrength = 0.7
+
+// ModelConfig 定义模型目录中的一个模型
+type ModelConfig struct {
+	ID           string                 `yaml:"id"`            // 对外暴露的模型 id
+	Model        string                 `yaml:"model"`         // 发送给 NovelAI 的模型名
+	Parameters   map[string]interface{} `yaml:"parameters"`    // 覆盖通用 parameters 的默认参数
+	Img2Img      bool                   `yaml:"img2img"`       // 是否支持图生图
+	VibeTransfer bool                   `yaml:"vibe_transfer"` // 是否支持 vibe transfer
+}
+
+// defaultModels 是配置文件未提供 models 时使用的模型目录
+var defaultModels = []ModelConfig{
+	{ID: "nai-diffusion-3", Model: "nai-diffusion-3", Img2Img: true, VibeTransfer: true},
+	{ID: "nai-diffusion-furry-3", Model: "nai-diffusion-furry-3", Img2Img: true, VibeTransfer: true},
+}
+
+// ModelObject 定义 /v1/models 返回的单个模型
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelList 定义 /v1/models 的响应结构体
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+// findModel 按 id 在模型目录中查找模型，找不到时返回 nil
+func findModel(config *Config, id string) *ModelConfig {
+	for i := range config.Models {
+		if config.Models[i].ID == id {
+			return &config.Models[i]
+		}
+	}
+	return nil
+}
+
+// Models 处理 /v1/models 请求，返回模型目录
+func Models(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	// 如果是 OPTIONS 请求，直接返回 200 OK
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	config := GetConfig()
+
+	session, apiErr := authenticateClient(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	resp := ModelList{Object: "list", Data: []ModelObject{}}
+	for _, model := range config.Models {
+		// 只列出调用方有权使用的模型
+		if !session.allowsModel(model.ID) {
+			continue
+		}
+		resp.Data = append(resp.Data, ModelObject{
+			ID:      model.ID,
+			Object:  "model",
+			OwnedBy: "novelai",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("写入响应失败: %v", err)
+	}
+}
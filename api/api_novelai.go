@@ -0,0 +1,378 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NovelAI 接口路径，前面拼接 novelai.image_url 或 novelai.api_url
+const (
+	novelAIGeneratePath     = "/ai/generate-image"
+	novelAISubscriptionPath = "/user/subscription" // 订阅信息，用于检查秘钥是否有效，不消耗点数
+)
+
+// 追加在正词、反词之后的固定词条
+const (
+	qualityTags  = ",best quality, amazing quality, very aesthetic, absurdres"
+	negativeTags = "pussy, nipples, nude, naked, nsfw, lowres, {bad}, error, fewer, extra, missing, worst quality, jpeg artifacts, bad quality, watermark, unfinished, displeasing, chromatic aberration, signature, extra digits, artistic error, username, scan, [abstract]"
+)
+
+// generateRequest 描述一次向 NovelAI 发起的画图任务
+type generateRequest struct {
+	Model          *ModelConfig
+	Prompt         string             // 最终发送的正词
+	NegativePrompt string             // 最终发送的反词
+	Width          int                // 为 0 时使用配置文件中的宽度
+	Height         int                // 为 0 时使用配置文件中的高度
+	NSamples       int                // 为 0 时使用配置文件中的数量
+	ReferenceImage string             // 参考图的 base64，可为空；按 ReferenceMode 与模型能力用于 vibe transfer 或图生图
+	ReferenceMode  string             // 参考图的用法：vibe_transfer、img2img，为空时模型支持 vibe transfer 则优先使用
+	Client         string             // 调用方名称，用于秘钥池的公平排队
+	OnQueue        func(position int) // 排队等待秘钥时的位置回调，可为 nil
+}
+
+// 参考图的用法，对应 generateRequest.ReferenceMode
+const (
+	referenceVibeTransfer = "vibe_transfer"
+	referenceImg2Img      = "img2img"
+)
+
+// referenceMode 返回参考图实际使用的用法，mode 为空时模型支持 vibe transfer 则优先使用
+// 模型不支持指定的用法时返回空字符串
+func referenceMode(model *ModelConfig, mode string) string {
+	switch {
+	case (mode == "" || mode == referenceVibeTransfer) && model.VibeTransfer:
+		return referenceVibeTransfer
+	case (mode == "" || mode == referenceImg2Img) && model.Img2Img:
+		return referenceImg2Img
+	}
+	return ""
+}
+
+// buildPayload 根据配置文件与任务参数组装 NovelAI 请求体
+// 参数的优先级从低到高依次为：配置文件中的通用参数、模型自带的默认参数、请求中明确指定的值
+func buildPayload(config *Config, g *generateRequest) map[string]interface{} {
+	// 生成一个0到999999之间的随机种子
+	randomSeed := rand.Intn(1000000)
+
+	payload := map[string]interface{}{
+		"input":  g.Prompt,
+		"model":  g.Model.Model,
+		"action": "generate",
+		"parameters": map[string]interface{}{
+			"params_version":                 config.Parameters.ParamsVersion,
+			"width":                          config.Parameters.Width,
+			"height":                         config.Parameters.Height,
+			"scale":                          config.Parameters.Scale,
+			"sampler":                        config.Parameters.Sampler,
+			"steps":                          config.Parameters.Steps,
+			"seed":                           randomSeed,
+			"n_samples":                      config.Parameters.NSamples,
+			"ucPreset":                       config.Parameters.UCPreset,
+			"qualityToggle":                  config.Parameters.QualityToggle,
+			"sm":                             config.Parameters.SM,
+			"sm_dyn":                         config.Parameters.SMDyn,
+			"dynamic_thresholding":           config.Parameters.DynamicThresholding,
+			"controlnet_strength":            config.Parameters.ControlNetStrength,
+			"legacy":                         config.Parameters.Legacy,
+			"add_original_image":             config.Parameters.AddOriginalImage,
+			"cfg_rescale":                    config.Parameters.CFGRescale,
+			"noise_schedule":                 config.Parameters.NoiseSchedule,
+			"legacy_v3_extend":               config.Parameters.LegacyV3Extend,
+			"skip_cfg_above_sigma":           config.Parameters.SkipCFGAboveSigma,
+			"deliberate_euler_ancestral_bug": config.Parameters.DeliberateEulerAncestralBug,
+			"prefer_brownian":                config.Parameters.PreferBrownian,
+		},
+	}
+
+	parameters := payload["parameters"].(map[string]interface{})
+
+	// 模型自带的默认参数覆盖配置文件中的通用参数
+	for name, value := range g.Model.Parameters {
+		parameters[name] = value
+	}
+
+	// 请求中明确指定的尺寸、张数与反词优先于所有默认参数，张数与调用方额度的预留保持一致
+	if g.Width > 0 && g.Height > 0 {
+		parameters["width"], parameters["height"] = g.Width, g.Height
+	}
+	if g.NSamples > 0 {
+		parameters["n_samples"] = g.NSamples
+	}
+	parameters["negative_prompt"] = g.NegativePrompt
+
+	// 根据参考图的用法决定使用 vibe transfer 还是图生图
+	if g.ReferenceImage != "" {
+		switch referenceMode(g.Model, g.ReferenceMode) {
+		case referenceVibeTransfer:
+			parameters["reference_image_multiple"] = []interface{}{g.ReferenceImage}
+			parameters["reference_information_extracted_multiple"] = []interface{}{1}
+			parameters["reference_strength_multiple"] = []interface{}{0.6}
+		case referenceImg2Img:
+			payload["action"] = "img2img"
+			parameters["image"] = g.ReferenceImage
+			parameters["strength"] = defaultImg2ImgStrength
+			parameters["noise"] = 0
+			parameters["extra_noise_seed"] = randomSeed
+		}
+	}
+
+	return payload
+}
+
+// generateImages 从秘钥池中获取秘钥调用 NovelAI 画图，返回解压后的 PNG 数据
+// 返回的错误均为 *APIError
+// ctx 取消时（客户端断开或服务关闭）正在进行的 NovelAI 请求会被中断
+func generateImages(ctx context.Context, config *Config, g *generateRequest) ([][]byte, error) {
+	// 估算点数消耗，并按 pool.free_only 拒绝或降级会扣点的请求
+	payload := buildPayload(config, g)
+	cost, apiErr := applyCostPolicy(config, payload)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errInternal("failed to marshal payload: %v", err)
+	}
+	log.Println("Payload marshaled to JSON")
+
+	// 超时的请求按 failureTimeout 换秘钥重试，重试耗尽后返回 504
+	client := &http.Client{Timeout: config.NovelAI.Timeout}
+	retries := make(map[failureKind]int) // 每类失败已经重试的次数
+	var tried []string                   // 本次请求已经失败过的秘钥
+	for attempt := 1; ; attempt++ {
+		// 从秘钥池获取密钥，优先避开已经失败过的秘钥
+		key, err := keyPool.Acquire(ctx, AcquireOptions{
+			Client:  g.Client,
+			Timeout: config.Pool.AcquireTimeout,
+			Exclude: tried,
+			Cost:    &cost,
+			OnQueue: g.OnQueue,
+		})
+		if err != nil {
+			return nil, keyAcquireError(err, config.Pool.AcquireTimeout)
+		}
+
+		body, err := doGenerateRequest(ctx, client, config.NovelAI.ImageURL+novelAIGeneratePath, key, payloadBytes)
+		if err == nil {
+			keyPool.MarkHealthy(key)
+			keyPool.SpendAnlas(key, cost)
+		}
+		// 无论成功与否都先释放 key 值
+		keyPool.Release(key)
+
+		// 客户端断开或服务关闭时不再重试
+		if ctx.Err() != nil {
+			return nil, errCancelled("request cancelled: %v", ctx.Err())
+		}
+
+		if err == nil {
+			images, err := extractImages(body)
+			if err != nil {
+				return nil, errUpstream("%v", err)
+			}
+			keyPool.RecordUsage(key, len(images))
+			return images, nil
+		}
+
+		kind := classifyFailure(err)
+		var apiErr *APIError
+		switch kind {
+		case failureUnauthorized:
+			// 401 状态码指的是 API 密钥未经过身份验证，连续多次后秘钥会被隔离
+			state := keyPool.ReportAuthFailure(key)
+			log.Printf("API Key unauthorized (401), key is now %s: %v", state, err)
+			// 账号登录得到的令牌失效时后台重新登录，新令牌会替换旧令牌
+			accountPool.onUnauthorized(key)
+			apiErr = errUpstream("API Key unauthorized. Key potential expired or invalid")
+		case failureRateLimited:
+			var upErr *upstreamError
+			errors.As(err, &upErr)
+			cooldown := keyPool.Cooldown(key, upErr.RetryAfter)
+			apiErr = errPoolExhausted("All NovelAI keys are rate limited, please retry later")
+			apiErr.RetryAfter = cooldown
+		case failureNoAnlas:
+			keyPool.MarkNoAnlas(key)
+			apiErr = errInsufficientAnlas("NovelAI keys do not have enough Anlas for this request")
+		case failureTimeout:
+			apiErr = errUpstreamTimeout("NovelAI request timed out: %v", err)
+		case failureServer:
+			apiErr = errUpstream("NovelAI request failed: %v", err)
+		default:
+			// 其他错误（例如参数错误）换秘钥也不会成功，直接返回
+			return nil, errUpstream("NovelAI rejected the request: %v", err)
+		}
+
+		policy := retryPolicies[kind]
+		if retries[kind] >= policy.retries || attempt >= maxGenerateAttempts {
+			log.Printf("重试次数耗尽: %v", err)
+			return nil, apiErr
+		}
+		retries[kind]++
+		if policy.switchKey {
+			tried = append(tried, key)
+		}
+
+		// 按策略等待后重试，期间 ctx 取消则立即返回
+		delay := policy.delay << (retries[kind] - 1)
+		log.Printf("Request failed, retrying in %s (attempt %d/%d)... err: %v", delay, attempt+1, maxGenerateAttempts, err)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, errCancelled("request cancelled: %v", ctx.Err())
+			}
+		}
+	}
+}
+
+// keyAcquireError 将获取秘钥失败的原因转换为对应的 APIError
+func keyAcquireError(err error, timeout time.Duration) *APIError {
+	switch {
+	case errors.Is(err, ErrNoKeys):
+		return errNoKeys()
+	case errors.Is(err, ErrKeysQuarantined):
+		return errKeysQuarantined()
+	case errors.Is(err, ErrInsufficientAnlas):
+		return errInsufficientAnlas("No NovelAI key has enough Anlas for this request")
+	case errors.Is(err, ErrAcquireTimeout):
+		return errPoolExhausted("All NovelAI keys are busy, no key became available within %s. Please retry later.", timeout)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return errCancelled("request cancelled while waiting for a key: %v", err)
+	default:
+		return errInternal("error getting key: %v", err)
+	}
+}
+
+// isTimeout 判断请求错误是否由超时引起
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// doGenerateRequest 使用指定秘钥发送一次画图请求，返回响应体
+// 非 200 响应以 *upstreamError 返回，请求未发出或无响应时返回普通错误
+func doGenerateRequest(ctx context.Context, client *http.Client, url, key string, payload []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new request: %w", err)
+	}
+
+	// 设置请求头
+	request.Header.Set("Authorization", "Bearer "+key)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "*/*")
+	request.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
+	request.Header.Set("Cache-Control", "no-cache")
+	request.Header.Set("Origin", "https://novelai.net")
+	request.Header.Set("Pragma", "no-cache")
+	request.Header.Set("Referer", "https://novelai.net/")
+
+	// 发送请求
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("(发送请求失败)failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{
+			Status:     resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return body, nil
+}
+
+// extractImages 从 NovelAI 返回的 ZIP 中按文件名顺序取出所有 PNG
+func extractImages(zipData []byte) ([][]byte, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ZIP file: %w", err)
+	}
+
+	files := make([]*zip.File, 0, len(zipReader.File))
+	for _, file := range zipReader.File {
+		if strings.HasSuffix(file.Name, ".png") {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	images := make([][]byte, 0, len(files))
+	for _, file := range files {
+		srcFile, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("打开 ZIP 中的文件失败: %w", err)
+		}
+		data, err := io.ReadAll(srcFile)
+		srcFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取 ZIP 中的文件失败: %w", err)
+		}
+		images = append(images, data)
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no image found in ZIP file")
+	}
+	return images, nil
+}
+
+// uploadImage 将图片写入本地文件并通过配置的推送程序上传，返回图片公网链接与上传的文件名
+func uploadImage(config *Config, imageData []byte) (link, imageName string, err error) {
+	imageName = fmt.Sprintf("%d.png", time.Now().UnixNano())
+	// 推送脚本成功时会自行删除文件，失败或进程退出时由这里兜底清理
+	registerTempFile(imageName)
+	defer removeTempFile(imageName)
+	if err := os.WriteFile(imageName, imageData, 0644); err != nil {
+		return "", "", fmt.Errorf("创建图像文件失败: %w", err)
+	}
+	log.Printf("Image saved as: ./%s", imageName)
+
+	var cmd *exec.Cmd
+	// 判断推送类型
+	if config.Channel.Name == "Alist" {
+		cmd = exec.Command("sh", "Alist.sh",
+			"--username", config.Alist.Username,
+			"--password", config.Alist.Password,
+			imageName, config.Alist.Dir)
+	} else {
+		cmd = exec.Command("sh", "Minio.sh",
+			config.Minio.Alias, config.Minio.Url,
+			config.Minio.AccessKey, config.Minio.SecretKey,
+			imageName, config.Minio.Bucket)
+	}
+
+	// 执行命令并获取输出
+	output, err := cmd.CombinedOutput() // CombinedOutput captures both stdout and stderr
+	if err != nil {
+		return "", "", fmt.Errorf("命令执行失败: %s 错误: %w", output, err)
+	}
+
+	return strings.ReplaceAll(string(output), "\n", ""), imageName, nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// zipImages 按 NovelAI 的响应格式把图片打包为 ZIP
+func zipImages(t *testing.T, images ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, image := range images {
+		f, err := zw.Create(fmt.Sprintf("image_%d.png", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(image); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useFakeNovelAI 启动一个模拟的 NovelAI 画图接口，并让秘钥池只包含给定的秘钥
+// 返回的配置已指向模拟接口
+func useFakeNovelAI(t *testing.T, handler http.HandlerFunc, modify func(c *Config), keys ...string) *Config {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	oldPool := keyPool
+	keyPool = newTestPool(keys...)
+	t.Cleanup(func() { keyPool = oldPool })
+
+	return useTestConfig(t, func(c *Config) {
+		c.NovelAI.ImageURL = server.URL
+		if modify != nil {
+			modify(c)
+		}
+	})
+}
+
+func TestGenerateImagesUpstreamTimeout(t *testing.T) {
+	png := []byte("\x89PNG fake")
+	body := zipImages(t, png)
+	tests := []struct {
+		name       string
+		delay      time.Duration // 模拟接口响应前等待的时间
+		wantStatus int           // 为 0 表示成功
+		wantCode   string
+	}{
+		{name: "fast response", delay: 0},
+		{name: "slow response", delay: 300 * time.Millisecond, wantStatus: http.StatusGatewayTimeout, wantCode: "upstream_timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := tt.delay
+			var calls atomic.Int32
+			config := useFakeNovelAI(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write(body)
+			}, func(c *Config) { c.NovelAI.Timeout = 50 * time.Millisecond }, "a", "b")
+
+			start := time.Now()
+			images, err := generateImages(context.Background(), config, &generateRequest{Model: &config.Models[0], Prompt: "cat"})
+			if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+				t.Errorf("generateImages took %s, want it bounded by novelai.timeout", elapsed)
+			}
+
+			if tt.wantStatus == 0 {
+				if err != nil || len(images) != 1 || !bytes.Equal(images[0], png) {
+					t.Fatalf("generateImages() = %d images, %v", len(images), err)
+				}
+				return
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.wantStatus || apiErr.Code != tt.wantCode {
+				t.Fatalf("generateImages() error = %#v, want %d %s", err, tt.wantStatus, tt.wantCode)
+			}
+			// 超时后换秘钥重试一次
+			if n := calls.Load(); n != 2 {
+				t.Errorf("NovelAI called %d times, want 2", n)
+			}
+		})
+	}
+}
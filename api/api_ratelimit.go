@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// tokenBucket 是按每分钟请求数限流的令牌桶，桶容量等于每分钟请求数
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 尝试取出一个令牌，失败时返回需要等待的时间
+func (b *tokenBucket) take(rpm int, now time.Time) (ok bool, wait time.Duration) {
+	capacity := float64(rpm)
+	perSecond := capacity / 60
+
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * perSecond
+	}
+	// 限额调小时多余的令牌直接丢弃
+	b.tokens = math.Min(b.tokens, capacity)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// rateLimitRPM 返回调用方实际生效的每分钟请求数限制，0 表示不限
+func (c *ClientKey) rateLimitRPM(config *Config) int {
+	switch {
+	case c.RateLimitRPM < 0:
+		return 0
+	case c.RateLimitRPM > 0:
+		return c.RateLimitRPM
+	default:
+		return config.Clients.RateLimitRPM
+	}
+}
+
+// checkRateLimit 按调用方的每分钟请求数限制消耗一个令牌，超出时返回 429
+func (s *clientSession) checkRateLimit(config *Config) *APIError {
+	if s.master {
+		return nil
+	}
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	client := clients.clients[s.Name]
+	if client == nil {
+		return errInvalidAPIKey()
+	}
+	rpm := client.rateLimitRPM(config)
+	if rpm <= 0 {
+		return nil
+	}
+
+	bucket := clients.buckets[s.Name]
+	if bucket == nil {
+		bucket = &tokenBucket{}
+		clients.buckets[s.Name] = bucket
+	}
+	ok, wait := bucket.take(rpm, time.Now())
+	if ok {
+		return nil
+	}
+
+	apiErr := newAPIError(http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded", "",
+		fmt.Sprintf("Rate limit reached for this API key (%d requests per minute). Please retry after %.1fs.", rpm, wait.Seconds()))
+	apiErr.RetryAfter = wait
+	return apiErr
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxGenerateAttempts 是一次画图请求最多尝试的次数（含第一次）
+const maxGenerateAttempts = 5
+
+// upstreamError 表示 NovelAI 返回了非 200 响应
+type upstreamError struct {
+	Status     int
+	RetryAfter time.Duration // 响应中 Retry-After 的值，没有时为 0
+	Body       string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned %d %s: %s", e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// failureKind 是上游失败的分类，每类有各自的重试方式
+type failureKind int
+
+const (
+	failureOther        failureKind = iota // 其他错误，例如 400 参数错误，重试也不会成功
+	failureUnauthorized                    // 401，秘钥失效
+	failureRateLimited                     // 429，秘钥被限流
+	failureNoAnlas                         // 402，秘钥点数不足
+	failureServer                          // 5xx 或连接失败，NovelAI 自身的问题
+	failureTimeout                         // 请求超时
+)
+
+// retryPolicy 描述一类上游失败的重试方式
+type retryPolicy struct {
+	retries   int           // 该类失败最多重试几次
+	delay     time.Duration // 第一次重试前等待的时间，之后每次翻倍
+	switchKey bool          // 是否优先换一个秘钥重试
+}
+
+// retryPolicies 为每类失败定义重试方式
+//   - 401: 可能是 NovelAI 的偶发问题，记一次失败后立即换秘钥重试
+//   - 429: 秘钥进入冷却，立即换秘钥重试
+//   - 402: 点数不足只与该秘钥有关，立即换秘钥重试，秘钥仍可用于不扣点的请求
+//   - 5xx: 多半是 NovelAI 整体故障，稍等后重试
+//   - 超时: 画图本身很慢，只换秘钥重试一次
+var retryPolicies = map[failureKind]retryPolicy{
+	failureUnauthorized: {retries: maxGenerateAttempts - 1, switchKey: true},
+	failureRateLimited:  {retries: maxGenerateAttempts - 1, switchKey: true},
+	failureNoAnlas:      {retries: maxGenerateAttempts - 1, switchKey: true},
+	failureServer:       {retries: 2, delay: 2 * time.Second, switchKey: true},
+	failureTimeout:      {retries: 1, switchKey: true},
+}
+
+// classifyFailure 判断一次失败请求属于哪类失败
+func classifyFailure(err error) failureKind {
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		if isTimeout(err) {
+			return failureTimeout
+		}
+		// 连接失败等没有拿到响应的情况
+		return failureServer
+	}
+
+	switch {
+	case upErr.Status == http.StatusUnauthorized:
+		return failureUnauthorized
+	case upErr.Status == http.StatusTooManyRequests:
+		return failureRateLimited
+	case upErr.Status == http.StatusPaymentRequired:
+		return failureNoAnlas
+	case upErr.Status == http.StatusGatewayTimeout:
+		return failureTimeout
+	case upErr.Status >= 500:
+		return failureServer
+	default:
+		return failureOther
+	}
+}
+
+// parseRetryAfter 解析 Retry-After 响应头，支持秒数与 HTTP 日期两种格式
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want failureKind
+	}{
+		{name: "401", err: &upstreamError{Status: http.StatusUnauthorized}, want: failureUnauthorized},
+		{name: "429", err: &upstreamError{Status: http.StatusTooManyRequests}, want: failureRateLimited},
+		{name: "402", err: &upstreamError{Status: http.StatusPaymentRequired}, want: failureNoAnlas},
+		{name: "500", err: &upstreamError{Status: http.StatusInternalServerError}, want: failureServer},
+		{name: "504", err: &upstreamError{Status: http.StatusGatewayTimeout}, want: failureTimeout},
+		{name: "400", err: &upstreamError{Status: http.StatusBadRequest}, want: failureOther},
+		{name: "wrapped 429", err: fmt.Errorf("attempt 2: %w", &upstreamError{Status: http.StatusTooManyRequests}), want: failureRateLimited},
+		{name: "deadline", err: fmt.Errorf("request: %w", context.DeadlineExceeded), want: failureTimeout},
+		{name: "connection refused", err: errors.New("dial tcp: connection refused"), want: failureServer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyFailure(tt.err); got != tt.want {
+				t.Errorf("classifyFailure() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "-1", want: 0},
+		{value: "Mon, 01 Jan 2024 12:01:30 GMT", want: 90 * time.Second},
+		{value: "Mon, 01 Jan 2024 11:59:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+)
+
+// activeGenerations 记录正在进行的画图任务（从调用 NovelAI 到推送完成）
+var activeGenerations sync.WaitGroup
+
+// tempFiles 记录写入工作目录、尚未推送完成的图片文件
+var (
+	tempFiles      = make(map[string]struct{})
+	tempFilesMutex sync.Mutex
+)
+
+// beginGeneration 标记一个画图任务开始，返回的函数在任务结束时调用
+func beginGeneration() (done func()) {
+	activeGenerations.Add(1)
+	return activeGenerations.Done
+}
+
+// WaitGenerations 等待所有进行中的画图任务结束，ctx 到期时返回 ctx 的错误
+func WaitGenerations(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		activeGenerations.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// registerTempFile 记录一个临时图片文件
+func registerTempFile(name string) {
+	tempFilesMutex.Lock()
+	defer tempFilesMutex.Unlock()
+	tempFiles[name] = struct{}{}
+}
+
+// removeTempFile 删除临时图片文件并取消记录，文件已被推送脚本删除时忽略
+func removeTempFile(name string) {
+	tempFilesMutex.Lock()
+	defer tempFilesMutex.Unlock()
+	delete(tempFiles, name)
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Printf("删除临时文件 %s 失败: %v", name, err)
+	}
+}
+
+// CleanupTempFiles 删除所有仍被记录的临时图片文件，用于进程退出前清理
+func CleanupTempFiles() {
+	tempFilesMutex.Lock()
+	defer tempFilesMutex.Unlock()
+	for name := range tempFiles {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除临时文件 %s 失败: %v", name, err)
+			continue
+		}
+		log.Printf("已删除临时文件: %s", name)
+		delete(tempFiles, name)
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseKeepAliveInterval 是生成过程中发送保活注释的间隔，避免 New-API 等网关判定超时
+const sseKeepAliveInterval = 15 * time.Second
+
+// sseWriter 按 OpenAI chat.completion.chunk 的格式输出 SSE 流
+// 所有写操作都由 mu 保护，保活 goroutine 与业务写入可以并发调用
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	id      string
+	model   string
+	created int64
+}
+
+// newSSEWriter 创建一个 SSE 输出器，ResponseWriter 不支持 Flush 时返回错误
+func newSSEWriter(w http.ResponseWriter, model string) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming unsupported by response writer")
+	}
+	now := time.Now()
+	return &sseWriter{
+		w:       w,
+		flusher: flusher,
+		id:      fmt.Sprintf("chatcmpl-%d", now.UnixNano()),
+		model:   model,
+		created: now.Unix(),
+	}, nil
+}
+
+// Start 写入 SSE 响应头并发送携带 role 的首个 chunk
+func (s *sseWriter) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := s.w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // 关闭 nginx 缓冲
+	s.w.WriteHeader(http.StatusOK)
+
+	return s.writeChunk(&Delta{Role: "assistant"}, nil)
+}
+
+// Content 发送一段增量内容
+func (s *sseWriter) Content(content string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeChunk(&Delta{Content: content}, nil)
+}
+
+// Finish 发送 finish_reason 为 stop 的结束 chunk 以及 [DONE] 终止符
+func (s *sseWriter) Finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finishReason := "stop"
+	if err := s.writeChunk(&Delta{}, &finishReason); err != nil {
+		return err
+	}
+	return s.writeRaw("data: [DONE]\n\n")
+}
+
+// Error 在流已经开始后发送错误 chunk 以及 [DONE] 终止符
+func (s *sseWriter) Error(apiErr *APIError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(map[string]*APIError{"error": apiErr})
+	if err != nil {
+		return fmt.Errorf("failed to marshal error chunk: %w", err)
+	}
+	if err := s.writeRaw("data: " + string(data) + "\n\n"); err != nil {
+		return err
+	}
+	return s.writeRaw("data: [DONE]\n\n")
+}
+
+// QueuePosition 以 SSE 注释行推送当前的排队位置，不影响 OpenAI 客户端的解析
+func (s *sseWriter) QueuePosition(position int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeRaw(fmt.Sprintf(": queue_position %d\n\n", position))
+}
+
+// KeepAlive 启动一个 goroutine 定期发送 SSE 注释行，返回的函数用于停止保活
+// stop 返回时 goroutine 已经退出，之后不会再写入 ResponseWriter
+func (s *sseWriter) KeepAlive(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// done 与 ticker 同时就绪时 select 可能选中 ticker，写入前再检查一次
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.mu.Lock()
+				err := s.writeRaw(": keep-alive\n\n")
+				s.mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+// writeChunk 序列化一个 chat.completion.chunk，调用方需持有 mu
+func (s *sseWriter) writeChunk(delta *Delta, finishReason *string) error {
+	chunk := Response{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []Choice{
+			{
+				Delta:        delta,
+				FinishReason: finishReason,
+				Index:        0,
+			},
+		},
+	}
+
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk: %w", err)
+	}
+	return s.writeRaw("data: " + string(data) + "\n\n")
+}
+
+// writeRaw 写入原始数据并立即刷新，调用方需持有 mu
+func (s *sseWriter) writeRaw(data string) error {
+	if _, err := s.w.Write([]byte(data)); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
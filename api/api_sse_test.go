@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvents 按空行拆分 SSE 响应体
+func sseEvents(body string) []string {
+	return strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+}
+
+func TestSSEWriterFraming(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(s *sseWriter) error
+		want  []string // 每个事件的前缀，"chunk" 表示一个 chat.completion.chunk
+		check func(t *testing.T, chunks []Response)
+	}{
+		{
+			name: "content stream",
+			write: func(s *sseWriter) error {
+				if err := s.Content("![a.png](https://example.com/a.png)"); err != nil {
+					return err
+				}
+				return s.Finish()
+			},
+			want: []string{"chunk", "chunk", "chunk", "data: [DONE]"},
+			check: func(t *testing.T, chunks []Response) {
+				if chunks[0].Choices[0].Delta.Role != "assistant" {
+					t.Errorf("first chunk role = %q, want assistant", chunks[0].Choices[0].Delta.Role)
+				}
+				if got := chunks[1].Choices[0].Delta.Content; got != "![a.png](https://example.com/a.png)" {
+					t.Errorf("content chunk = %q", got)
+				}
+				if fr := chunks[2].Choices[0].FinishReason; fr == nil || *fr != "stop" {
+					t.Errorf("last chunk finish_reason = %v, want stop", fr)
+				}
+				for _, chunk := range chunks {
+					if chunk.Object != "chat.completion.chunk" || chunk.Model != "nai-diffusion-3" || chunk.ID != chunks[0].ID {
+						t.Errorf("inconsistent chunk header: %+v", chunk)
+					}
+				}
+			},
+		},
+		{
+			name: "content is JSON-escaped",
+			write: func(s *sseWriter) error {
+				return s.Content("say \"hi\"\n\nline2")
+			},
+			want: []string{"chunk", "chunk"},
+			check: func(t *testing.T, chunks []Response) {
+				if got := chunks[1].Choices[0].Delta.Content; got != "say \"hi\"\n\nline2" {
+					t.Errorf("content chunk = %q", got)
+				}
+			},
+		},
+		{
+			name: "queue position comment",
+			write: func(s *sseWriter) error {
+				return s.QueuePosition(3)
+			},
+			want: []string{"chunk", ": queue_position 3"},
+		},
+		{
+			name: "error after start",
+			write: func(s *sseWriter) error {
+				return s.Error(errUpstream("boom"))
+			},
+			want: []string{"chunk", `data: {"error":`, "data: [DONE]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s, err := newSSEWriter(rec, "nai-diffusion-3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.write(s); err != nil {
+				t.Fatal(err)
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", ct)
+			}
+			if !strings.HasSuffix(rec.Body.String(), "\n\n") {
+				t.Errorf("stream does not end with a blank line: %q", rec.Body.String())
+			}
+			events := sseEvents(rec.Body.String())
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d: %q", len(events), len(tt.want), events)
+			}
+
+			var chunks []Response
+			for i, event := range events {
+				if tt.want[i] != "chunk" {
+					if !strings.HasPrefix(event, tt.want[i]) {
+						t.Errorf("event %d = %q, want prefix %q", i, event, tt.want[i])
+					}
+					continue
+				}
+				var chunk Response
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+					t.Fatalf("event %d is not a JSON chunk: %q", i, event)
+				}
+				chunks = append(chunks, chunk)
+			}
+			if tt.check != nil {
+				tt.check(t, chunks)
+			}
+		})
+	}
+}
+
+func TestSSEWriterKeepAliveStop(t *testing.T) {
+	rec := httptest.NewRecorder()
+	s, err := newSSEWriter(rec, "nai-diffusion-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := s.KeepAlive(time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	stop() // 可以重复调用
+
+	// stop 返回后不会再有写入
+	written := rec.Body.Len()
+	time.Sleep(20 * time.Millisecond)
+	if rec.Body.Len() != written {
+		t.Errorf("keep-alive wrote after stop returned")
+	}
+	if !strings.Contains(rec.Body.String(), ": keep-alive\n\n") {
+		t.Errorf("no keep-alive comment written: %q", rec.Body.String())
+	}
+}
@@ -2,45 +2,189 @@ package main
 
 import (
 	"NoveAI3/api"
-	"fmt"
-	"github.com/spf13/viper"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// configPath 配置文件地址
+const configPath = "config.yml"
+
+// cancelGrace 是关闭时取消进行中的请求后，等待处理函数返回的最长时间
+const cancelGrace = 5 * time.Second
+
 func main() {
-	//获取图片保存路径
-	viper.SetConfigFile("config.yml")
+	// 启动时加载并校验配置文件，之后所有处理函数共享同一份配置
+	config, err := api.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	api.SetConfig(config)
+
+	// 加载 NovelAI 秘钥池，之后秘钥库只由秘钥池读写
+	if err := api.InitKeyPool(config.Nkey); err != nil {
+		log.Fatalf("Failed to load keys: %v", err)
+	}
+
+	// 加载 NovelAI 账号，账号登录得到的令牌保存在秘钥池中
+	if err := api.InitAccounts(config.Accounts); err != nil {
+		log.Fatalf("Failed to load accounts: %v", err)
+	}
 
-	// 读取配置文件
-	err := viper.ReadInConfig()
+	// 监听秘钥文件，外部修改后自动重新加载秘钥池
+	// 关闭秘钥池之前先停止监听，避免关闭后还有重新加载
+	stopKeyWatch, err := api.WatchKeyFile(config.Nkey.Path)
 	if err != nil {
-		fmt.Printf("Error reading config file: %s\n", err)
-		return
-	} else {
-		//fmt.Println("配置文件加载成功.......")
+		log.Printf("Key file reload disabled: %v", err)
+		stopKeyWatch = func() {}
+	}
+
+	// 加载调用方 API key 注册表
+	if err := api.InitClients(config.Clients.Path); err != nil {
+		log.Fatalf("Failed to load clients: %v", err)
 	}
-	// 读取配置文件
-	configFile, err := os.Open("config.yml")
+
+	// 监听配置文件，修改后自动热加载
+	stopWatch, err := api.WatchConfig(configPath)
 	if err != nil {
-		log.Fatalf("Error opening config file: %v", err)
+		log.Printf("Config hot reload disabled: %v", err)
+	} else {
+		defer stopWatch()
+	}
+
+	// 所有处理函数都经过 Recover 包装，单个请求 panic 不会导致进程退出
+	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("/v1/chat/completions", api.Recover(api.Completions)) // 修改了路由
+	apiMux.HandleFunc("/v1/images/generations", api.Recover(api.ImagesGenerations))
+	apiMux.HandleFunc("/v1/models", api.Recover(api.Models))
+
+	// 所有请求的 context 都派生自 baseCtx，关闭超时后通过它取消进行中的 NovelAI 请求
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	servers := []*http.Server{newServer(baseCtx, config.Server, config.Server.Addr(), apiMux)}
+
+	// 管理接口可以单独监听（例如只监听 127.0.0.1），未配置时与 API 共用端口
+	// 没有配置 admin.secret 时不注册管理接口，避免持有 sk.key 的调用方管理秘钥池
+	if config.Admin.Secret == "" {
+		log.Println("admin.secret is not set, admin endpoints and /web/ are disabled")
+	} else {
+		adminMux := apiMux
+		if config.Server.AdminAddress != "" {
+			adminMux = http.NewServeMux()
+			servers = append(servers, newServer(baseCtx, config.Server, config.Server.AdminAddress, adminMux))
+		}
+		registerAdminRoutes(adminMux)
 	}
-	defer configFile.Close()
 
-	//Port := viper.GetString("start.port")
-	Port := "3388"
+	errCh := make(chan error, len(servers))
+	for _, server := range servers {
+		go serve(server, config.Server, errCh)
+	}
 
-	http.HandleFunc("/v1/chat/completions", api.Completions) // 修改了路由
-	http.HandleFunc("/tokens/upload", api.HandleUploadTokens)
-	http.HandleFunc("/tokens/count", api.HandleGetAvailableTokensCount)
-	http.HandleFunc("/tokens", api.HandleClearTokens)           // 使用 DELETE 方法清空
-	http.HandleFunc("/tokens/errors", api.HandleGetErrorTokens) // 如果你实现了这个接口
-	http.HandleFunc("/web/", api.WebCheck)                      // 前端页面
+	// 收到 SIGTERM/SIGINT 后优雅关闭
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Println("Starting server on : ", Port)
+	// 定期探测被隔离的秘钥，探测成功后自动恢复；定期检查所有秘钥的订阅状态
+	api.StartKeyProber(ctx)
+	api.StartKeyHealthChecker(ctx)
+	// 账号的令牌过期前自动重新登录
+	api.StartAccountRefresher(ctx)
 
-	if err := http.ListenAndServe(":"+Port, nil); err != nil {
+	select {
+	case err := <-errCh:
 		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	shutdown(servers, api.GetConfig().Server.ShutdownTimeout, cancelRequests, stopKeyWatch)
+}
+
+// shutdown 停止接收新请求，在截止时间内等待进行中的画图任务推送完成，
+// 超时后取消所有请求并关闭连接，再等待处理函数返回，最后停止秘钥文件监听、释放仍被占用的秘钥并清理临时文件
+func shutdown(servers []*http.Server, timeout time.Duration, cancelRequests context.CancelFunc, stopKeyWatch func()) {
+	log.Printf("Shutting down, waiting up to %s for in-flight requests...", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Server %s shutdown: %v", server.Addr, err)
+		}
+	}
+	if err := api.WaitGenerations(ctx); err != nil {
+		log.Printf("Timed out waiting for in-flight generations: %v", err)
+	}
+	// 超时后取消进行中的 NovelAI 请求并关闭剩余连接
+	// Close 不等待处理函数返回，秘钥与临时文件要等它们结束后再清理
+	cancelRequests()
+	for _, server := range servers {
+		server.Close()
+	}
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), cancelGrace)
+	defer graceCancel()
+	if err := api.WaitGenerations(graceCtx); err != nil {
+		log.Printf("Generations still running %s after cancelling them: %v", cancelGrace, err)
+	}
+
+	stopKeyWatch()
+	if released := api.ReleaseAllKeys(); released > 0 {
+		log.Printf("Released %d keys still in use", released)
+	}
+	if err := api.CloseKeyPool(); err != nil {
+		log.Printf("Failed to close key store: %v", err)
+	}
+	api.CleanupTempFiles()
+	log.Println("Server stopped")
+}
+
+// registerAdminRoutes 注册管理接口与管理页面
+func registerAdminRoutes(mux *http.ServeMux) {
+	// /tokens*、/accounts* 需要管理秘钥；/web/ 只提供静态页面，页面内的请求会携带秘钥
+	mux.HandleFunc("/tokens/upload", api.Recover(api.AdminAuth(api.HandleUploadTokens)))
+	mux.HandleFunc("/tokens/count", api.Recover(api.AdminAuth(api.HandleGetAvailableTokensCount)))
+	mux.HandleFunc("/tokens", api.Recover(api.AdminAuth(api.HandleClearTokens)))            // 使用 DELETE 方法清空
+	mux.HandleFunc("/tokens/errors", api.Recover(api.AdminAuth(api.HandleGetErrorTokens)))  // 如果你实现了这个接口
+	mux.HandleFunc("/tokens/history", api.Recover(api.AdminAuth(api.HandleKeyTransitions))) // 秘钥状态变化记录
+	mux.HandleFunc("/tokens/keys", api.Recover(api.AdminAuth(api.HandleListKeys)))          // 所有秘钥及状态
+	mux.HandleFunc("/tokens/keys/", api.Recover(api.AdminAuth(api.HandleKey)))              // 按 id 恢复或删除秘钥
+	mux.HandleFunc("/tokens/export", api.Recover(api.AdminAuth(api.HandleExportTokens)))    // 导出 JSON/CSV
+	mux.HandleFunc("/tokens/import", api.Recover(api.AdminAuth(api.HandleImportTokens)))    // 导入 JSON/CSV
+	mux.HandleFunc("/accounts", api.Recover(api.AdminAuth(api.HandleAccounts)))             // NovelAI 账号列表与添加
+	mux.HandleFunc("/accounts/", api.Recover(api.AdminAuth(api.HandleAccount)))             // 按 id 删除账号或重新登录
+	mux.HandleFunc("/clients", api.Recover(api.AdminAuth(api.HandleClients)))               // 调用方 API key 管理
+	mux.HandleFunc("/web/", api.Recover(api.WebCheck))                                      // 前端页面
+}
+
+// newServer 按配置创建 http.Server，请求的 context 派生自 baseCtx
+func newServer(baseCtx context.Context, cfg api.ServerConfig, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+}
+
+// serve 启动服务，按配置选择 HTTP 或 HTTPS，异常退出时将错误写入 errCh
+func serve(server *http.Server, cfg api.ServerConfig, errCh chan<- error) {
+	var err error
+	if cfg.TLSEnabled() {
+		log.Println("Starting HTTPS server on : ", server.Addr)
+		err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		log.Println("Starting server on : ", server.Addr)
+		err = server.ListenAndServe()
+	}
+	// Shutdown 引起的退出不算错误
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errCh <- err
 	}
 }
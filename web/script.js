@@ -5,12 +5,52 @@
 const API_BASE_URL = "/"; // 假设 API 接口直接挂在根路径下，例如 /tokens/upload
 // 如果你的 API 在 /api 前缀下，可以设置为 "/api"
 
+// 管理秘钥保存在 sessionStorage 中，关闭标签页后需要重新输入
+const ADMIN_SECRET_STORAGE_KEY = "novel-admin-secret";
+
+// 获取管理秘钥，没有保存过或 forcePrompt 为 true 时弹窗让用户输入
+function getAdminSecret(forcePrompt, message) {
+    let secret = sessionStorage.getItem(ADMIN_SECRET_STORAGE_KEY);
+    if (!secret || forcePrompt) {
+        secret = prompt(message || "请输入管理秘钥 (config.yml 中的 admin.secret)：");
+        if (secret) {
+            secret = secret.trim();
+            sessionStorage.setItem(ADMIN_SECRET_STORAGE_KEY, secret);
+        }
+    }
+    return secret || "";
+}
+
+// 带管理秘钥的 fetch，秘钥错误 (401) 时提示重新输入并重试一次
+async function authFetch(url, options = {}) {
+    const send = (secret) => fetch(url, Object.assign({}, options, {
+        headers: Object.assign({}, options.headers, { 'Authorization': `Bearer ${secret}` })
+    }));
+
+    let response = await send(getAdminSecret(false));
+    if (response.status === 401) {
+        sessionStorage.removeItem(ADMIN_SECRET_STORAGE_KEY);
+        const secret = getAdminSecret(true, "管理秘钥错误，请重新输入：");
+        if (secret) {
+            response = await send(secret);
+        }
+    }
+    return response;
+}
+
+// 退出登录，清除保存的管理秘钥
+function logout() {
+    sessionStorage.removeItem(ADMIN_SECRET_STORAGE_KEY);
+    alert("已退出登录。");
+    location.reload();
+}
+
 // 获取当前可用 Tokens 数量
 async function getAvailableTokensCount() {
     const countElement = document.getElementById('available-tokens-count');
     try {
         // 假设后端有一个 GET /tokens/count 接口返回可用数量
-        const response = await fetch(`${API_BASE_URL}tokens/count`); // 使用相对路径
+        const response = await authFetch(`${API_BASE_URL}tokens/count`); // 使用相对路径
         if (response.ok) {
             const data = await response.json();
             countElement.textContent = data.count; // 假设后端返回 { count: 4 }
@@ -24,29 +64,38 @@ async function getAvailableTokensCount() {
     }
 }
 
-// 上传密钥列表到服务器
+// 上传密钥列表到服务器，mode 为 append(追加)、replace(替换) 或 remove(删除)
 async function uploadTokens() {
     const tokensTextarea = document.getElementById('tokens');
     const tokensContent = tokensTextarea.value;
     const tokensArray = tokensContent.split('\n').map(line => line.trim()).filter(line => line !== ""); // 按行分割，去除首尾空格和空行
+    const mode = document.getElementById('upload-mode').value;
+
+    if (mode === 'replace' && !confirm("替换会删除所有不在列表中的 Tokens，确定继续吗？")) {
+        return;
+    }
 
     try {
-        // 假设后端有一个 POST /tokens/upload 接口，接收一个包含 tokens 数组的 JSON
-        const response = await fetch(`${API_BASE_URL}tokens/upload`, { // 使用相对路径
+        // POST /tokens/upload 接收 tokens 数组与上传方式，返回每个 Token 的处理结果
+        const response = await authFetch(`${API_BASE_URL}tokens/upload`, { // 使用相对路径
             method: 'POST',
             headers: {
-                'Content-Type': 'application/json',
-                // 如果后端需要认证，可以在这里添加认证头
+                'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ tokens: tokensArray })
+            body: JSON.stringify({ tokens: tokensArray, mode: mode })
         });
 
         if (response.ok) {
-            alert("密钥已成功上传！");
+            const report = await response.json();
+            showUploadReport(report);
             // 上传成功后更新可用 Tokens 数量
             getAvailableTokensCount();
             // 清空错误 Tokens 显示
             document.getElementById('error-tokens-display').style.display = 'none';
+        } else if (mode === 'replace' && response.status === 400 && response.headers.get('Content-Type') === 'application/json') {
+            // 替换被拒绝时后端返回同样的报告，现有 Tokens 没有变化
+            showUploadReport(await response.json());
+            alert("替换已取消：有 Token 被拒绝或没有有效的 Token，现有 Tokens 没有变化。");
         } else {
             const errorData = await response.text(); // 尝试获取后端返回的错误信息
             alert(`上传失败: ${response.statusText}${errorData ? ' - ' + errorData : ''}`);
@@ -58,6 +107,22 @@ async function uploadTokens() {
     }
 }
 
+// 显示上传结果：新增、删除、跳过（重复）与拒绝（格式错误或已过期）的 Tokens
+function showUploadReport(report) {
+    const display = document.getElementById('upload-report-display');
+    const section = (title, items) => {
+        if (!items || items.length === 0) {
+            return '';
+        }
+        const lines = items.map(item => item.reason ? `  ${item.token}  (${item.reason})` : `  ${item.token}`);
+        return `${title} ${items.length} 个:\n${lines.join('\n')}\n`;
+    };
+    const text = section('新增', report.added) + section('删除', report.removed) +
+        section('跳过', report.skipped) + section('拒绝', report.rejected);
+    display.textContent = text || '没有任何变化。';
+    display.style.display = 'block';
+}
+
 // 查看错误 Tokens（需要后端提供相关接口）
 async function viewErrorTokens() {
     const errorDisplay = document.getElementById('error-tokens-display');
@@ -66,7 +131,7 @@ async function viewErrorTokens() {
 
     try {
         // 假设后端有一个 GET /tokens/errors 接口返回错误密钥列表
-        const response = await fetch(`${API_BASE_URL}tokens/errors`); // 使用相对路径
+        const response = await authFetch(`${API_BASE_URL}tokens/errors`); // 使用相对路径
         if (response.ok) {
             const data = await response.json(); // 假设返回 { errors: ["invalid_token1", "invalid_token2"] }
             if (data.errors && Array.isArray(data.errors) && data.errors.length > 0) {
@@ -88,14 +153,236 @@ async function viewErrorTokens() {
     }
 }
 
+// 秘钥状态的中文名称
+const KEY_STATE_NAMES = {
+    active: "正常",
+    cooling: "冷却中",
+    quarantined: "已隔离",
+    disabled: "已失效",
+};
+
+// 转义 HTML，避免备注等内容被当作 HTML 解析
+function escapeHTML(value) {
+    const div = document.createElement('div');
+    div.textContent = value == null ? '' : String(value);
+    return div.innerHTML;
+}
+
+// 查看全部 Tokens 及其状态，非正常的 Token 可以恢复，任何 Token 都可以删除
+async function listKeys() {
+    const display = document.getElementById('keys-display');
+    try {
+        const response = await authFetch(`${API_BASE_URL}tokens/keys`);
+        if (!response.ok) {
+            const errorData = await response.text();
+            alert(`获取 Tokens 失败: ${response.statusText}${errorData ? ' - ' + errorData : ''}`);
+            return;
+        }
+        const data = await response.json();
+        if (!data.keys || data.keys.length === 0) {
+            display.textContent = "没有 Tokens。";
+            display.style.display = 'block';
+            return;
+        }
+
+        const rows = data.keys.map(key => {
+            const state = escapeHTML(key.state);
+            const info = key.info ? `${escapeHTML(key.info.tier_name)} / ${key.info.anlas}` : '';
+            const activate = key.state !== 'active'
+                ? `<button class="upload-button" onclick="activateKey('${escapeHTML(key.id)}')">恢复</button>` : '';
+            return `<tr>
+                <td title="${escapeHTML(key.id)}">${escapeHTML(key.token)}</td>
+                <td class="state-${state}" title="${escapeHTML(key.disabled_reason || '')}">${escapeHTML(KEY_STATE_NAMES[key.state] || key.state)}</td>
+                <td>${escapeHTML(key.label || '')}</td>
+                <td>${info}</td>
+                <td>${key.today.requests} / ${key.total_requests}</td>
+                <td>${activate}
+                    <button class="clear-tokens-button" onclick="deleteKey('${escapeHTML(key.id)}')">删除</button></td>
+            </tr>`;
+        });
+        display.innerHTML = `<table>
+            <tr><th>Token</th><th>状态</th><th>备注</th><th>订阅 / 点数</th><th>今日 / 累计</th><th></th></tr>
+            ${rows.join('')}
+        </table>`;
+        display.style.display = 'block';
+    } catch (error) {
+        console.error("Error listing tokens:", error);
+        alert("获取 Tokens 过程中发生错误。");
+    }
+}
+
+// 恢复单个 Token：失效的 Token 移回可用列表，冷却或隔离中的 Token 立即恢复
+async function activateKey(id) {
+    const response = await authFetch(`${API_BASE_URL}tokens/keys/${encodeURIComponent(id)}/activate`, { method: 'POST' });
+    if (!response.ok) {
+        alert(`恢复失败: ${await response.text()}`);
+    }
+    getAvailableTokensCount();
+    listKeys();
+}
+
+// 删除单个 Token
+async function deleteKey(id) {
+    if (!confirm("确定要删除这个 Token 吗？")) {
+        return;
+    }
+    const response = await authFetch(`${API_BASE_URL}tokens/keys/${encodeURIComponent(id)}`, { method: 'DELETE' });
+    if (!response.ok) {
+        alert(`删除失败: ${await response.text()}`);
+    }
+    getAvailableTokensCount();
+    listKeys();
+}
+
+// 导出全部 Tokens（包含完整 Token），format 为 json 或 csv
+async function exportTokens(format) {
+    try {
+        const response = await authFetch(`${API_BASE_URL}tokens/export?format=${format}`);
+        if (!response.ok) {
+            alert(`导出失败: ${await response.text()}`);
+            return;
+        }
+        const blob = await response.blob();
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = `tokens.${format}`;
+        link.click();
+        URL.revokeObjectURL(link.href);
+    } catch (error) {
+        console.error("Error exporting tokens:", error);
+        alert("导出过程中发生错误。");
+    }
+}
+
+// 导入之前导出的 JSON 或 CSV 文件，已存在的 Token 会被跳过
+async function importTokens(input) {
+    const file = input.files[0];
+    input.value = '';
+    if (!file) {
+        return;
+    }
+    const format = file.name.toLowerCase().endsWith('.csv') ? 'csv' : 'json';
+    try {
+        const response = await authFetch(`${API_BASE_URL}tokens/import?format=${format}`, {
+            method: 'POST',
+            headers: { 'Content-Type': format === 'csv' ? 'text/csv' : 'application/json' },
+            body: await file.text(),
+        });
+        if (!response.ok) {
+            alert(`导入失败: ${await response.text()}`);
+            return;
+        }
+        showUploadReport(await response.json());
+        getAvailableTokensCount();
+        listKeys();
+    } catch (error) {
+        console.error("Error importing tokens:", error);
+        alert("导入过程中发生错误。");
+    }
+}
+
+// 格式化时间，零值显示为空
+function formatTime(value) {
+    if (!value || value.startsWith('0001-')) {
+        return '';
+    }
+    return new Date(value).toLocaleString();
+}
+
+// 登录 NovelAI 账号，成功后账号的 Token 会加入列表
+async function addAccount() {
+    const email = document.getElementById('account-email').value.trim();
+    const password = document.getElementById('account-password').value;
+    const label = document.getElementById('account-label').value.trim();
+    if (!email || !password) {
+        alert("请输入邮箱和密码。");
+        return;
+    }
+    try {
+        const response = await authFetch(`${API_BASE_URL}accounts`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ email: email, password: password, label: label }),
+        });
+        if (!response.ok) {
+            alert(`添加失败: ${await response.text()}`);
+            return;
+        }
+        document.getElementById('account-password').value = '';
+        getAvailableTokensCount();
+        listAccounts();
+    } catch (error) {
+        console.error("Error adding account:", error);
+        alert("添加账号过程中发生错误。");
+    }
+}
+
+// 查看全部账号及其 Token 的过期时间与最近一次登录错误
+async function listAccounts() {
+    const display = document.getElementById('accounts-display');
+    try {
+        const response = await authFetch(`${API_BASE_URL}accounts`);
+        if (!response.ok) {
+            alert(`获取账号失败: ${await response.text()}`);
+            return;
+        }
+        const data = await response.json();
+        if (!data.accounts || data.accounts.length === 0) {
+            display.textContent = "没有账号。";
+            display.style.display = 'block';
+            return;
+        }
+
+        const rows = data.accounts.map(account => `<tr>
+                <td>${escapeHTML(account.email)}</td>
+                <td>${escapeHTML(account.label || '')}</td>
+                <td title="${escapeHTML(account.key_id || '')}">${escapeHTML(account.token || '')}</td>
+                <td>${escapeHTML(formatTime(account.expires_at))}</td>
+                <td class="state-quarantined">${escapeHTML(account.last_error || '')}</td>
+                <td><button class="upload-button" onclick="reloginAccount('${escapeHTML(account.id)}')">重新登录</button>
+                    <button class="clear-tokens-button" onclick="deleteAccount('${escapeHTML(account.id)}')">删除</button></td>
+            </tr>`);
+        display.innerHTML = `<table>
+            <tr><th>邮箱</th><th>备注</th><th>Token</th><th>过期时间</th><th>错误</th><th></th></tr>
+            ${rows.join('')}
+        </table>`;
+        display.style.display = 'block';
+    } catch (error) {
+        console.error("Error listing accounts:", error);
+        alert("获取账号过程中发生错误。");
+    }
+}
+
+// 立即重新登录账号，新 Token 替换旧 Token
+async function reloginAccount(id) {
+    const response = await authFetch(`${API_BASE_URL}accounts/${encodeURIComponent(id)}/login`, { method: 'POST' });
+    if (!response.ok) {
+        alert(`登录失败: ${await response.text()}`);
+    }
+    getAvailableTokensCount();
+    listAccounts();
+}
+
+// 删除账号，同时删除它的 Token
+async function deleteAccount(id) {
+    if (!confirm("确定要删除这个账号及其 Token 吗？")) {
+        return;
+    }
+    const response = await authFetch(`${API_BASE_URL}accounts/${encodeURIComponent(id)}`, { method: 'DELETE' });
+    if (!response.ok) {
+        alert(`删除失败: ${await response.text()}`);
+    }
+    getAvailableTokensCount();
+    listAccounts();
+}
+
 // 清空所有 Tokens
 async function clearTokens() {
     if (confirm("确定要清空所有 Tokens 吗？此操作不可撤销！")) {
         try {
             // 假设后端有一个 DELETE /tokens 接口用于清空
-            const response = await fetch(`${API_BASE_URL}tokens`, { // 使用相对路径
+            const response = await authFetch(`${API_BASE_URL}tokens`, { // 使用相对路径
                 method: 'DELETE',
-                // 如果后端需要认证，可以在这里添加认证头
             });
 
             if (response.ok) {
@@ -104,8 +391,9 @@ async function clearTokens() {
                 getAvailableTokensCount();
                 // 清空文本框内容
                 document.getElementById('tokens').value = '';
-                // 隐藏错误 Tokens 显示
+                // 隐藏错误 Tokens 与上传结果显示
                 document.getElementById('error-tokens-display').style.display = 'none';
+                document.getElementById('upload-report-display').style.display = 'none';
             } else {
                 const errorData = await response.text();
                 alert(`清空失败: ${response.statusText}${errorData ? ' - ' + errorData : ''}`);